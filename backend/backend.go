@@ -1,9 +1,11 @@
 package backend
 
 import (
+	"encoding/base64"
+	"errors"
+	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -17,59 +19,205 @@ type Handler interface {
 	Handle(messageKey string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message)
 }
 
+// VarsHandler is a Handler that receives the variables matched by its path, such as containerId for
+// a handler registered as "/v1/stats/{containerId}". HandleVars is called instead of Handle.
+type VarsHandler interface {
+	Handler
+	HandleVars(messageKey string, initialMessage string, vars map[string]string, incomingMessages <-chan string, response chan<- common.Message)
+}
+
+// HalfCloseHandler is a Handler that can keep responding after the frontend is done sending, like
+// an exec whose stdin was piped in. When the frontend finishes, incomingMessages is closed but the
+// stream stays open until the handler returns or calls SignalHandlerClosed. Streams for handlers
+// that don't implement it, or return false, are closed when the frontend finishes, as they always
+// have been.
+type HalfCloseHandler interface {
+	Handler
+	SupportsHalfClose() bool
+}
+
+// LinkLostHandler is a Handler that wants to know when its stream ended because the connection to
+// the proxy was lost, rather than closed by the frontend. LinkLost is called before
+// incomingMessages is closed and must not block. Work the handler started may carry on and be
+// picked up again by the frontend once the agent has reconnected.
+type LinkLostHandler interface {
+	Handler
+	LinkLost(messageKey string)
+}
+
+// ErrLinkLost is returned by reads on streams opened by a Dialer when the connection to the proxy
+// is lost.
+var ErrLinkLost = errors.New("Connection to the proxy was lost")
+
+// ConnectToProxy connects to the proxy once and serves streams until the connection is lost. Use a
+// Client to stay connected.
 func ConnectToProxy(proxyURL string, handlers map[string]Handler) error {
-	log.WithFields(log.Fields{"url": proxyURL}).Info("Connecting to proxy.")
+	return ConnectToProxyWithOptions(proxyURL, handlers, Options{})
+}
+
+// ConnectToProxyWithOptions is ConnectToProxy with options for the connection.
+func ConnectToProxyWithOptions(proxyURL string, handlers map[string]Handler, opts Options) error {
+	ws, err := dialProxy(proxyURL, nil, opts)
+	if err != nil {
+		return err
+	}
+	return connectToProxyWS(ws, handlers, opts)
+}
 
-	dialer := &websocket.Dialer{}
+// dialProxy opens the websocket to the proxy. header is sent along with opts.Headers, taking
+// precedence over them.
+func dialProxy(proxyURL string, header http.Header, opts Options) (*websocket.Conn, error) {
+	log.WithFields(log.Fields{"url": redactToken(proxyURL)}).Info("Connecting to proxy.")
+
+	netDialer := &net.Dialer{Timeout: opts.HandshakeTimeout}
+	dialer := &websocket.Dialer{
+		Subprotocols:      []string{common.BinaryProtocol},
+		EnableCompression: !opts.DisableCompression,
+		TLSClientConfig:   opts.TLSConfig,
+		Proxy:             opts.Proxy,
+		HandshakeTimeout:  opts.HandshakeTimeout,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := netDialer.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &common.CountingConn{Conn: conn}, nil
+		},
+	}
 	headers := http.Header{}
-	ws, _, err := dialer.Dial(proxyURL, headers)
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+	for k, v := range header {
+		headers[k] = v
+	}
+	ws, resp, err := dialer.Dial(proxyURL, headers)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to connect to proxy.")
-		return err
+		return nil, err
 	}
 
-	return connectToProxyWS(ws, handlers)
+	if err := opts.compression().Start(ws, common.Negotiated(resp.Header)); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// redactToken hides the JWT in a proxy URL so it can be logged.
+func redactToken(proxyURL string) string {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return proxyURL
+	}
+	query := u.Query()
+	if query.Get("token") != "" {
+		query.Set("token", "REDACTED")
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// ping sends a keepalive to the proxy, whose pong is seen by the pongHandler.
+func ping(ws *websocket.Conn, opts Options) {
+	timeout := opts.WriteTimeout
+	if timeout <= 0 {
+		timeout = pingWriteTimeout
+	}
+	ws.WriteControl(websocket.PingMessage, []byte(""), deadline(timeout))
+}
+
+func connectToProxyWS(ws *websocket.Conn, handlers map[string]Handler, opts Options) error {
+	return serveLink(ws, newLink(), handlers, opts)
 }
 
-func connectToProxyWS(ws *websocket.Conn, handlers map[string]Handler) error {
-	responders := make(map[string]chan string)
-	responseChannel := make(chan common.Message, 10)
+func serveLink(ws *websocket.Conn, l *link, handlers map[string]Handler, opts Options) error {
+	scheduler := l.scheduler
+	defer scheduler.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	protocol := ws.Subprotocol()
+	compression := opts.compression()
+	reassembler := common.NewReassembler(opts.maxMessageSize())
+	router := newRouter(handlers)
+
+	if opts.Dialer != nil {
+		opts.Dialer.attach(l)
+		defer opts.Dialer.detach(l)
+	}
 
 	// Write messages to proxy
 	go func() {
-		ticker := time.NewTicker(time.Second * 5)
+		ticker := time.NewTicker(opts.keepAliveInterval())
 		defer ticker.Stop()
 		for {
-			select {
-			case message, ok := <-responseChannel:
-				if !ok {
+			message, ok := scheduler.Next()
+			if !ok {
+				select {
+				case <-scheduler.Ready():
+					continue
+				case <-ticker.C:
+					ping(ws, opts)
+					continue
+				case <-stop:
 					return
 				}
-				data := common.FormatMessage(message.Key, message.Type, message.Body)
-				ws.WriteMessage(1, []byte(data))
+			}
+
+			msgType, data, err := common.EncodeMessage(protocol, message)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Failed to encode message.")
+				continue
+			}
+			ws.SetWriteDeadline(deadline(opts.WriteTimeout))
+			compression.WriteMessage(ws, msgType, data)
+
+			select {
 			case <-ticker.C:
-				ws.WriteControl(websocket.PingMessage, []byte(""), time.Now().Add(time.Second))
+				ping(ws, opts)
+			default:
 			}
 		}
 	}()
 
-	ph := newPongHandler(ws)
+	ph := newPongHandler(ws, opts)
 	ws.SetPongHandler(ph.handle)
 
+	handshake := opts.handshake()
+	if l.sessions == nil {
+		// Streams are closed with the connection, don't let the proxy keep them
+		handshake.MessageTypes = common.WithoutMessageType(handshake.MessageTypes, common.Resume)
+	}
+	if protocol != common.BinaryProtocol {
+		// Reverse streams carry raw bytes, which text frames can't hold
+		handshake.MessageTypes = common.WithoutMessageType(handshake.MessageTypes, common.ReverseConnect)
+	}
+	hello, err := common.NewHello(handshake)
+	if err != nil {
+		return err
+	}
+	scheduler.Push(hello)
+
 	// Read and route messages from proxy
 	for {
-		_, msg, err := ws.ReadMessage()
+		if opts.ReadTimeout > 0 {
+			ws.SetReadDeadline(deadline(opts.ReadTimeout))
+		}
+		msgType, msg, err := compression.ReadMessage(ws)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("Received error reading from socket. Exiting.")
-			for _, msgChan := range responders {
-				close(msgChan)
-			}
+			l.closeAll(err)
 			return err
 		}
 
-		message := common.ParseMessage(string(msg))
+		message, err := common.DecodeMessage(protocol, msgType, msg)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Dropping message that could not be decoded.")
+			continue
+		}
+
 		switch message.Type {
 		case common.Connect:
 			requestURL, err := url.Parse(message.Body)
@@ -77,63 +225,140 @@ func connectToProxyWS(ws *websocket.Conn, handlers map[string]Handler) error {
 				continue
 			}
 
-			handler, ok := getHandler(requestURL.Path, handlers)
-			if ok {
-				msgChan := make(chan string, 10)
-				responders[message.Key] = msgChan
-				go handler.Handle(message.Key, message.Body, msgChan, responseChannel)
-			} else {
+			route, vars, ok := router.match(requestURL.Path)
+			if l.isDraining() {
+				scheduler.Push(common.NewClose(message.Key, common.CloseUnavailable, "agent is shutting down"))
+			} else if !ok {
 				log.WithFields(log.Fields{"path": requestURL.Path}).Warn("Could not find appropriate message handler for supplied path.")
-				responseChannel <- common.Message{
-					Key:  message.Key,
-					Type: common.Close,
-					Body: ""}
+				scheduler.Push(common.NewClose(message.Key, common.CloseNotFound, "handler missing for path "+requestURL.Path))
+			} else if reason, admitted := opts.Limiter.acquire(route.pattern); !admitted {
+				log.WithFields(log.Fields{"path": requestURL.Path, "handler": route.pattern}).Warn("Refusing stream over the concurrency limit.")
+				scheduler.Push(common.NewClose(message.Key, common.CloseTooManyRequests, reason))
+			} else {
+				handler := route.handler
+				r := newResponder(message.Key, l.fragmenter)
+				if l.resumable() {
+					r.replay = common.NewReplayBuffer(l.sessions.bufferSize)
+				}
+				if h, ok := handler.(HalfCloseHandler); ok {
+					r.halfClose = h.SupportsHalfClose()
+				}
+				if protocol == common.BinaryProtocol {
+					// Proxies offering binary framing do flow control, wait for their grant
+					r.sendWindow.Require()
+				}
+				l.add(r)
+				// Opt in to flow control for the stream by granting the proxy its window
+				scheduler.SetPriority(message.Key, common.PathPriority(requestURL.Path))
+				scheduler.Push(common.NewWindowUpdate(message.Key, r.recvWindow.Size()))
+				r.serve(handler, message.Body, vars, scheduler)
+				go func(pattern string) {
+					l.release(r)
+					opts.Limiter.release(pattern)
+				}(route.pattern)
 			}
-		case common.Body:
-			if msgChan, ok := responders[message.Key]; ok {
-				msgChan <- message.Body
+		case common.Body, common.Fragment:
+			if r, ok := l.get(message.Key); ok {
+				credit := len(message.Body)
+				message, complete, err := reassembler.Add(message)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Warn("Closing stream that broke the frame limits.")
+					l.close(message.Key, common.CloseReason{Code: common.CloseProtocolError, Reason: err.Error()})
+					scheduler.Push(common.NewClose(message.Key, common.CloseProtocolError, err.Error()))
+				} else if complete {
+					r.countReceived()
+					r.enqueue(message, credit)
+				} else {
+					// The handler sees nothing until the last piece, return the credit now
+					r.credit(scheduler, credit)
+				}
 			} else {
 				log.WithFields(log.Fields{"key": message.Key}).Warn("Could not find responder for specified key.")
-				responseChannel <- common.Message{
-					Key:  message.Key,
-					Type: common.Close,
+				scheduler.Push(common.NewClose(message.Key, common.CloseNotFound, "stream not found"))
+			}
+		case common.GoingAway:
+			log.WithFields(log.Fields{"reason": message.Body}).Info("Proxy is going away.")
+			l.setProxyGoingAway()
+		case common.Hello:
+			proxyHello, err := common.ParseHello(message)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Warn("Invalid hello from proxy.")
+				continue
+			}
+			log.WithFields(log.Fields{
+				"version":      proxyHello.Version,
+				"messageTypes": proxyHello.MessageTypes,
+				"maxFrameSize": proxyHello.MaxFrameSize,
+			}).Info("Proxy accepted hello.")
+			l.setProxy(proxyHello)
+			if l.sessions != nil {
+				l.resumeParked(proxyHello.Supports(common.Resume))
+			}
+			if proxyHello.Supports(common.Fragment) && protocol == common.BinaryProtocol {
+				l.fragmenter.SetSize(proxyHello.MaxFrameSize)
+				ws.SetReadLimit(common.ReadLimit(opts.maxFrameSize()))
+				reassembler.LimitFrames(opts.maxFrameSize())
+			}
+		case common.WindowUpdate:
+			if r, ok := l.get(message.Key); ok {
+				if n, err := common.ParseWindowUpdate(message); err == nil && r.sendWindow.Grant(n) && r.accepted != nil {
+					// The proxy accepted a stream the agent opened, grant it the window for its responses
+					scheduler.Push(common.NewWindowUpdate(message.Key, r.recvWindow.Size()))
+					close(r.accepted)
+				}
+			}
+		case common.Resume:
+			if r, ok := l.get(message.Key); ok && r.replay != nil {
+				if err := l.resumed(r, message); err != nil {
+					log.WithFields(log.Fields{"error": err}).Warn("Closing stream the proxy failed to resume.")
+					l.close(message.Key, common.CloseReason{Code: common.CloseProtocolError, Reason: err.Error()})
+					scheduler.Push(common.NewClose(message.Key, common.CloseProtocolError, err.Error()))
+				}
+			}
+		case common.WriteDone:
+			if r, ok := l.get(message.Key); ok {
+				r.countReceived()
+				if r.halfClose {
+					r.enqueue(message, 0)
+				} else {
+					l.close(message.Key, common.CloseReason{Code: common.CloseNormal})
 				}
 			}
 		case common.Close:
-			closeHandler(responders, message.Key)
+			reassembler.Forget(message.Key)
+			if r, ok := l.get(message.Key); ok && r.isAccepted() {
+				// Let the dialer read what the destination sent before it closed
+				l.remove(message.Key)
+				r.enqueue(message, 0)
+				r.sendWindow.Close()
+			} else {
+				l.close(message.Key, common.ParseClose(message))
+			}
 		default:
 			log.WithFields(log.Fields{"messageType": message.Type}).Warn("Unrecognized message type. Closing connection.")
-			closeHandler(responders, message.Key)
-			SignalHandlerClosed(message.Key, responseChannel)
+			l.close(message.Key, common.CloseReason{Code: common.CloseProtocolError})
+			scheduler.Push(common.NewClose(message.Key, common.CloseProtocolError, "unrecognized message type"))
 			continue
 		}
 	}
 }
 
 // Returns the handler that best matches the provided path and true if one is found,
-// otherwise returns nil and false. This function is not robust enough to handle
-// pattern matching. If it can't find an exact match, it will look for a handler that
-// is a prefix for path. So, '/v1/stats/' will be a match for '/v1/stats/id-123'
+// otherwise returns nil and false. See router for how paths are matched.
 func getHandler(path string, handlers map[string]Handler) (Handler, bool) {
-	if handler, ok := handlers[path]; ok {
-		return handler, true
+	route, _, ok := newRouter(handlers).match(path)
+	if !ok {
+		return nil, false
 	}
-
-	path = strings.TrimSuffix(path, "/")
-	for key, handler := range handlers {
-		key = strings.TrimSuffix(key, "/")
-		if strings.HasPrefix(path, key) {
-			return handler, true
-		}
-	}
-	return nil, false
+	return route.handler, true
 }
 
-func closeHandler(responders map[string]chan string, msgKey string) {
-	if msgChan, ok := responders[msgKey]; ok {
-		close(msgChan)
-		delete(responders, msgKey)
+// legacyBody returns the body as handlers have always received it: binary bodies base64 encoded.
+func legacyBody(message common.Message) string {
+	if message.Binary {
+		return base64.StdEncoding.EncodeToString([]byte(message.Body))
 	}
+	return message.Body
 }
 
 func SignalHandlerClosed(msgKey string, response chan<- common.Message) {
@@ -144,3 +369,18 @@ func SignalHandlerClosed(msgKey string, response chan<- common.Message) {
 	response <- wrap
 
 }
+
+// SignalHandlerWriteDone tells the frontend that the handler won't send any more messages while it
+// keeps reading incoming messages. The stream stays open until SignalHandlerClosed.
+func SignalHandlerWriteDone(msgKey string, response chan<- common.Message) {
+	response <- common.Message{
+		Key:  msgKey,
+		Type: common.WriteDone,
+	}
+}
+
+// SignalHandlerClosedWithReason closes the stream with one of the common.Close* codes and a reason
+// such as "container not found". The proxy passes both on to the frontend.
+func SignalHandlerClosedWithReason(msgKey string, response chan<- common.Message, code int, reason string) {
+	response <- common.NewClose(msgKey, code, reason)
+}
@@ -1,11 +1,17 @@
 package backend
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
@@ -27,6 +33,7 @@ func TestMain(m *testing.M) {
 		Config:        c,
 	}
 	go ps.StartProxy()
+	time.Sleep(50 * time.Millisecond) // Give the proxy a chance to start listening
 
 	os.Exit(m.Run())
 }
@@ -43,7 +50,7 @@ func TestBackendGoesAway(t *testing.T) {
 
 	handlers := make(map[string]Handler)
 	handlers["/v1/echo"] = &echoHandler{}
-	go connectToProxyWS(backendWs, handlers)
+	go connectToProxyWS(backendWs, handlers, Options{})
 
 	signedToken = testutils.CreateToken("1", privateKey)
 	url = "ws://localhost:2223/v1/echo?token=" + signedToken
@@ -56,7 +63,7 @@ func TestBackendGoesAway(t *testing.T) {
 	ws.ReadMessage() // Read initial echo message
 	backendWs.Close()
 
-	if _, msg, err := ws.ReadMessage(); err != io.EOF {
+	if _, msg, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
 		t.Fatalf("Expected error indicating websocket was closed. Received: %s", msg)
 	}
 
@@ -83,7 +90,7 @@ func TestBackendReplaced(t *testing.T) {
 	}
 	defer backendWs2.Close()
 
-	go connectToProxyWS(backendWs2, map[string]Handler{"/v1/echo": &echoHandler{}})
+	go connectToProxyWS(backendWs2, map[string]Handler{"/v1/echo": &echoHandler{}}, Options{})
 
 	backendWs.Close()
 
@@ -102,7 +109,187 @@ func TestBackendReplaced(t *testing.T) {
 	}
 }
 
+func TestClientReconnectsWithFreshToken(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	upgrader := websocket.Upgrader{}
+	lost := &linkLostHandler{lost: make(chan string, 1)}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, req.URL.Query().Get("token"))
+		first := len(tokens) == 1
+		mu.Unlock()
+
+		ws, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		if first {
+			// Open a stream, then drop the agent
+			ws.WriteMessage(websocket.TextMessage, []byte(common.FormatMessage("key", common.Connect, "ws://host/v1/echo")))
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	count := 0
+	states := make(chan State, 20)
+	client := &Client{
+		URL: "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/connectbackend",
+		TokenFunc: func() (string, error) {
+			count++
+			return fmt.Sprintf("token-%v", count), nil
+		},
+		Handlers:   map[string]Handler{"/v1/echo": lost},
+		MinBackoff: 10 * time.Millisecond,
+		OnStateChange: func(state State, err error) {
+			states <- state
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- client.Run(ctx)
+	}()
+
+	expected := []State{StateConnecting, StateConnected, StateDisconnected, StateConnecting, StateConnected}
+	for _, state := range expected {
+		select {
+		case actual := <-states:
+			if actual != state {
+				t.Fatalf("Expected state %v, got %v", state, actual)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for state %v", state)
+		}
+	}
+	if key := <-lost.lost; key != "key" {
+		t.Fatalf("Expected link lost for key, got %v", key)
+	}
+
+	cancel()
+	if err := <-result; err != context.Canceled {
+		t.Fatalf("Expected Run to stop with the context, got %v", err)
+	}
+	if client.State() != StateStopped {
+		t.Fatalf("Expected client to be stopped, was %v", client.State())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tokens) != 2 || tokens[0] != "token-1" || tokens[1] != "token-2" {
+		t.Fatalf("Expected a fresh token for each attempt, got %v", tokens)
+	}
+}
+
+func TestClientBackoff(t *testing.T) {
+	client := &Client{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if delay := client.backoff(attempt); delay < max/2 || delay > max {
+			t.Errorf("Expected attempt %v to wait between %v and %v, got %v", attempt, max/2, max, delay)
+		}
+	}
+}
+
+func TestClientBackoffJitterIsPerClient(t *testing.T) {
+	first := &Client{MinBackoff: time.Minute, MaxBackoff: time.Minute}
+	second := &Client{MinBackoff: time.Minute, MaxBackoff: time.Minute}
+	differ := false
+	for i := 0; i < 5; i++ {
+		if first.backoff(0) != second.backoff(0) {
+			differ = true
+		}
+	}
+	if !differ {
+		t.Fatal("Expected two clients to pick different delays")
+	}
+	if first.jitter == nil || first.jitter == second.jitter {
+		t.Fatal("Expected each client to have its own random source")
+	}
+}
+
+func TestClientDialOptions(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	pings := make(chan struct{}, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+		ws, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		ws.SetPingHandler(func(data string) error {
+			pings <- struct{}{}
+			return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	// Only trust the test server's self-signed certificate
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	client := &Client{
+		URL: "wss" + strings.TrimPrefix(server.URL, "https") + "/v1/connectbackend",
+		TokenFunc: func() (string, error) {
+			return "token", nil
+		},
+		TokenInHeader: true,
+		Options: Options{
+			TLSConfig:         &tls.Config{RootCAs: roots},
+			Headers:           http.Header{"X-Agent": {"agent-1"}},
+			HandshakeTimeout:  time.Second,
+			KeepAliveInterval: 20 * time.Millisecond,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx)
+
+	select {
+	case header := <-headers:
+		if auth := header.Get("Authorization"); auth != "Bearer token" {
+			t.Fatalf("Expected the token in the Authorization header, got %q", auth)
+		}
+		if agent := header.Get("X-Agent"); agent != "agent-1" {
+			t.Fatalf("Expected the extra header, got %q", agent)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the agent to connect")
+	}
+
+	// Pings arrive at the configured interval rather than every five seconds
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pings:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for ping %v", i+1)
+		}
+	}
+}
+
 // Simple unit test for asserting the GetHandler algorithm
+func TestNilLimiterStats(t *testing.T) {
+	var limiter *Limiter
+	if stats := limiter.Stats(); stats.Active != 0 || stats.Max != 0 || stats.Rejected != 0 || len(stats.Handlers) != 0 {
+		t.Fatalf("Expected no counts from a nil limiter, got %+v", stats)
+	}
+}
+
 func TestGetHandler(t *testing.T) {
 	handlers := map[string]Handler{}
 	logKey := "/v1/logs/"
@@ -133,6 +320,43 @@ func TestGetHandler(t *testing.T) {
 	}
 }
 
+func TestRouterPicksMostSpecific(t *testing.T) {
+	handlers := map[string]Handler{
+		"/v1/":                     &mockHandler{hType: "v1"},
+		"/v1/stats/":               &mockHandler{hType: "stats"},
+		"/v1/stats/{id}":           &mockHandler{hType: "stats-id"},
+		"/v1/stats/project":        &mockHandler{hType: "stats-project"},
+		"/v1/{kind}/{id}/children": &mockHandler{hType: "children"},
+	}
+	cases := map[string]string{
+		"/v1/logs":                 "v1",
+		"/v1/stats":                "stats",
+		"/v1/stats/1234":           "stats-id",
+		"/v1/stats/project":        "stats-project",
+		"/v1/stats/1234/extra":     "stats-id",
+		"/v1/stats/1234/children":  "children",
+		"/v1/stats/project/extra/": "stats-project",
+	}
+	for i := 0; i < 10; i++ {
+		for path, expected := range cases {
+			if !assertHandler(path, expected, handlers, t) {
+				t.Fatalf("Expected %v for %v", expected, path)
+			}
+		}
+	}
+}
+
+func TestRouterVars(t *testing.T) {
+	router := newRouter(map[string]Handler{"/v1/{kind}/{id}": &mockHandler{}})
+	_, vars, ok := router.match("/v1/stats/1i5/extra")
+	if !ok || vars["kind"] != "stats" || vars["id"] != "1i5" {
+		t.Fatalf("Unexpected vars: %v", vars)
+	}
+	if _, _, ok := router.match("/v1/stats"); ok {
+		t.Fatal("Expected a path shorter than the template not to match")
+	}
+}
+
 func assertHandler(path string, expectedType string, handlers map[string]Handler, t *testing.T) bool {
 	if h, ok := getHandler(path, handlers); ok {
 		if mh, yes := h.(*mockHandler); yes && mh.hType == expectedType {
@@ -159,6 +383,15 @@ func getClientConnection(url string, t *testing.T) *websocket.Conn {
 	return ws
 }
 
+type linkLostHandler struct {
+	echoHandler
+	lost chan string
+}
+
+func (h *linkLostHandler) LinkLost(key string) {
+	h.lost <- key
+}
+
 type echoHandler struct {
 }
 
@@ -0,0 +1,295 @@
+package backend
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+// State is where a Client is in its connection to the proxy.
+type State int
+
+const (
+	// StateConnecting means the Client is dialing the proxy.
+	StateConnecting State = iota
+	// StateConnected means the Client is connected and routing streams to its handlers.
+	StateConnected
+	// StateDisconnected means the connection failed or was lost and the Client is waiting to retry.
+	StateDisconnected
+	// StateDraining means Drain was called and the Client is waiting for open streams to finish.
+	StateDraining
+	// StateStopped means Run returned because its context was done or it was drained.
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateDraining:
+		return "draining"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// Client keeps an agent connected to the proxy. Unlike ConnectToProxy it doesn't return when the
+// connection drops, it reconnects with exponential backoff and jitter until its context is done.
+type Client struct {
+	// URL is the proxy's backend endpoint, such as "ws://host/v1/connectbackend".
+	URL string
+	// TokenFunc returns the backend JWT for each connection attempt, so that tokens that expire can
+	// be refreshed. If it is nil, URL must already carry a token.
+	TokenFunc func() (string, error)
+	// TokenInHeader sends the token from TokenFunc as a bearer Authorization header instead of the
+	// token query parameter, so that it doesn't show up in the logs of proxies in between.
+	TokenInHeader bool
+	// Handlers route streams by path, as for ConnectToProxy.
+	Handlers map[string]Handler
+	Options  Options
+	// MinBackoff and MaxBackoff bound the wait between attempts. Zero means one second and one
+	// minute.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnStateChange, if set, is called whenever the state changes with the error that caused it, if
+	// any. It is called from Run's goroutine and must not block.
+	OnStateChange func(state State, err error)
+
+	mu       sync.Mutex
+	state    State
+	link     *link
+	ws       *websocket.Conn
+	sessions *sessions
+	drained  chan struct{}
+	// jitter is the client's own random source, so that agents started together don't pick the
+	// same delays. The global source isn't seeded.
+	jitter *rand.Rand
+}
+
+// State returns the current state of the client.
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *Client) setState(state State, err error) {
+	c.mu.Lock()
+	c.state = state
+	c.mu.Unlock()
+	if c.OnStateChange != nil {
+		c.OnStateChange(state, err)
+	}
+}
+
+// Run connects to the proxy and serves streams until ctx is done, reconnecting whenever the
+// connection fails. It returns ctx.Err(), or nil once the client has been drained.
+func (c *Client) Run(ctx context.Context) error {
+	c.mu.Lock()
+	if c.sessions == nil {
+		c.sessions = newSessions(c.Options)
+	}
+	sessions := c.sessions
+	c.mu.Unlock()
+	// Streams parked when the last connection was lost won't be resumed
+	defer sessions.close()
+
+	attempt := 0
+	for {
+		if c.isDrained() {
+			c.setState(StateStopped, nil)
+			return nil
+		}
+		c.setState(StateConnecting, nil)
+		connected, err := c.connect(ctx)
+		if ctx.Err() != nil {
+			c.setState(StateStopped, nil)
+			return ctx.Err()
+		}
+		if c.isDrained() {
+			c.setState(StateStopped, nil)
+			return nil
+		}
+		if connected {
+			attempt = 0
+		}
+		c.setState(StateDisconnected, err)
+
+		delay := c.backoff(attempt)
+		attempt++
+		log.WithFields(log.Fields{"error": err, "retryIn": delay}).Warn("Disconnected from proxy.")
+		select {
+		case <-time.After(delay):
+		case <-c.drainedChan():
+		case <-ctx.Done():
+			c.setState(StateStopped, nil)
+			return ctx.Err()
+		}
+	}
+}
+
+// Drain shuts the client down gracefully. The proxy is told that the agent is going away so that
+// it stops opening streams, and the open streams are given until ctx is done to finish. Then the
+// connection is closed and Run returns nil instead of reconnecting.
+func (c *Client) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	l, ws := c.link, c.ws
+	drained := c.drainedLocked()
+	select {
+	case <-drained:
+	default:
+		close(drained)
+	}
+	c.mu.Unlock()
+	c.setState(StateDraining, nil)
+
+	var err error
+	if l != nil {
+		err = l.drain(ctx, "agent is shutting down")
+	}
+	if ws != nil {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(common.CloseGoingAway, "agent is shutting down"),
+			time.Now().Add(time.Second))
+		ws.Close()
+	}
+	return err
+}
+
+func (c *Client) drainedChan() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.drainedLocked()
+}
+
+func (c *Client) drainedLocked() chan struct{} {
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	return c.drained
+}
+
+func (c *Client) isDrained() bool {
+	select {
+	case <-c.drainedChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// connect makes one connection to the proxy and serves it until it is lost. It reports whether the
+// connection was established.
+func (c *Client) connect(ctx context.Context) (bool, error) {
+	proxyURL, header, err := c.target()
+	if err != nil {
+		return false, err
+	}
+
+	ws, err := dialProxy(proxyURL, header, c.Options)
+	if err != nil {
+		return false, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(common.CloseNormal, "agent shutting down"),
+				time.Now().Add(time.Second))
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	l := newLink()
+	c.mu.Lock()
+	l.sessions = c.sessions
+	select {
+	case <-c.drainedLocked():
+		c.mu.Unlock()
+		ws.Close()
+		return false, nil
+	default:
+	}
+	c.link, c.ws = l, ws
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.link, c.ws = nil, nil
+		c.mu.Unlock()
+	}()
+
+	c.setState(StateConnected, nil)
+	return true, serveLink(ws, l, c.Handlers, c.Options)
+}
+
+// target returns the URL and extra handshake headers for the next attempt, carrying a fresh token.
+func (c *Client) target() (string, http.Header, error) {
+	if c.TokenFunc == nil {
+		return c.URL, nil, nil
+	}
+	token, err := c.TokenFunc()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if c.TokenInHeader {
+		return c.URL, http.Header{"Authorization": {"Bearer " + token}}, nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "", nil, err
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String(), nil, nil
+}
+
+// backoff returns how long to wait before the next attempt: a random duration between half and all
+// of MinBackoff doubled for every failed attempt, capped at MaxBackoff.
+func (c *Client) backoff(attempt int) time.Duration {
+	min, max := c.MinBackoff, c.MaxBackoff
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.jitter == nil {
+		c.jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return delay/2 + time.Duration(c.jitter.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pborman/uuid"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+var (
+	// ErrNotConnected is returned by a Dialer while the agent isn't connected to a proxy.
+	ErrNotConnected = errors.New("Not connected to the proxy")
+	// ErrReverseUnsupported is returned by a Dialer when the proxy doesn't route agent streams.
+	ErrReverseUnsupported = errors.New("Proxy doesn't support streams opened by the agent")
+	// ErrGoingAway is returned by a Dialer once the agent or the proxy has started shutting down.
+	ErrGoingAway = errors.New("Connection to the proxy is shutting down")
+)
+
+// Dialer opens streams from the agent to destinations behind the proxy, such as the Cattle API or
+// a metadata service, over the connection the agent already has. Set it in Options and dial once
+// the agent is connected; it follows the agent across reconnects. Destinations are names that
+// the proxy is configured with, not network addresses.
+type Dialer struct {
+	mu   sync.Mutex
+	link *link
+}
+
+func (d *Dialer) attach(l *link) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.link = l
+}
+
+func (d *Dialer) detach(l *link) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.link == l {
+		d.link = nil
+	}
+}
+
+func (d *Dialer) current() *link {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.link
+}
+
+// Dial opens a stream to the named destination.
+func (d *Dialer) Dial(destination string) (net.Conn, error) {
+	return d.DialContext(context.Background(), "tcp", destination)
+}
+
+// DialContext opens a stream to the destination named by address. It has the signature of
+// net.Dialer's so it can be an http.Transport's DialContext: the network and any port in address
+// are ignored, so "http://cattle/v3" reaches the destination named "cattle".
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	l := d.current()
+	if l == nil {
+		return nil, ErrNotConnected
+	}
+	if !l.supports(common.ReverseConnect) {
+		return nil, ErrReverseUnsupported
+	}
+	if l.isDraining() || l.isProxyGoingAway() {
+		return nil, ErrGoingAway
+	}
+
+	destination := address
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		destination = host
+	}
+
+	r := newResponder(uuid.New(), l.fragmenter)
+	r.raw = true
+	r.accepted = make(chan struct{})
+	r.sendWindow.Require()
+	l.add(r)
+	r.start(l.scheduler)
+	l.scheduler.Push(common.Message{Key: r.key, Type: common.ReverseConnect, Body: destination})
+
+	select {
+	case <-r.accepted:
+		return &Stream{Key: r.key, link: l, r: r, destination: destination}, nil
+	case <-r.done:
+		close(r.handlerDone)
+		return nil, fmt.Errorf("Proxy refused stream to %v: %v", destination, r.closeReason.Reason)
+	case <-ctx.Done():
+		l.close(r.key, common.CloseReason{Code: common.CloseNormal})
+		close(r.handlerDone)
+		l.scheduler.Push(common.Message{Key: r.key, Type: common.Close})
+		return nil, ctx.Err()
+	}
+}
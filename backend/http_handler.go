@@ -0,0 +1,283 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+// HTTPHandler serves the HTTP requests that the proxy's FrontendHTTPHandler pipes to the agent,
+// such as those for /v1/container-proxy/, with an http.Handler. Handler is typically an
+// httputil.ReverseProxy to the container. Request and response bodies are streamed. Requests the
+// proxy hijacks, like upgrades, are served with a ResponseWriter that implements http.Hijacker.
+type HTTPHandler struct {
+	Handler http.Handler
+}
+
+func (h *HTTPHandler) Handle(key string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message) {
+	defer SignalHandlerClosed(key, response)
+
+	body := &httpBodyReader{incoming: incomingMessages}
+	message, err := body.next()
+	if err != nil {
+		log.WithFields(log.Fields{"key": key, "error": err}).Error("Failed to read HTTP request from proxy.")
+		return
+	}
+
+	req, err := newHTTPRequest(message, body)
+	if err != nil {
+		log.WithFields(log.Fields{"key": key, "error": err}).Error("Invalid HTTP request from proxy.")
+		writeHTTPMessage(key, response, &common.HTTPMessage{Code: http.StatusBadRequest, Body: []byte(err.Error())})
+		writeHTTPMessage(key, response, &common.HTTPMessage{EOF: true})
+		return
+	}
+
+	rw := &httpResponseWriter{
+		key:      key,
+		response: response,
+		header:   http.Header{},
+		raw:      message.Hijack,
+		body:     body,
+	}
+	h.Handler.ServeHTTP(rw, req)
+	rw.finish()
+}
+
+// newHTTPRequest builds the request a proxy described in the first message of a stream. Requests
+// that the proxy hijacked have no body, everything that follows goes to the hijacked connection.
+func newHTTPRequest(message *common.HTTPMessage, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(message.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Hijack {
+		body = nil
+	}
+	req, err := http.NewRequest(message.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = http.Header(message.Headers)
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Host = message.Host
+	req.RequestURI = u.RequestURI()
+	if !message.Hijack {
+		req.ContentLength = -1
+		if length, err := strconv.ParseInt(req.Header.Get("Content-Length"), 10, 64); err == nil {
+			req.ContentLength = length
+		}
+	}
+	return req, nil
+}
+
+// httpBodyReader reads the request body, or the input of a hijacked connection, from the
+// HTTPMessages the proxy sends after the request.
+type httpBodyReader struct {
+	incoming <-chan string
+	buffer   []byte
+	eof      bool
+}
+
+func (b *httpBodyReader) next() (*common.HTTPMessage, error) {
+	data, ok := <-b.incoming
+	if !ok {
+		return nil, io.EOF
+	}
+	message := &common.HTTPMessage{}
+	if err := json.Unmarshal([]byte(data), message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (b *httpBodyReader) Read(out []byte) (int, error) {
+	for len(b.buffer) == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+		message, err := b.next()
+		if err != nil {
+			b.eof = true
+			return 0, err
+		}
+		if message.EOF {
+			b.eof = true
+		}
+		b.buffer = message.Body
+	}
+
+	n := copy(out, b.buffer)
+	b.buffer = b.buffer[n:]
+	return n, nil
+}
+
+// httpResponseWriter sends a response back the way BackendHTTPReader expects it: the status code
+// and headers in the first HTTPMessage, then the body, then EOF. For requests the proxy hijacked
+// the response is written as raw bytes instead, either by the handler after it hijacks the
+// connection or serialized here if it doesn't.
+type httpResponseWriter struct {
+	key         string
+	response    chan<- common.Message
+	header      http.Header
+	raw         bool
+	body        *httpBodyReader
+	wroteHeader bool
+	hijacked    *hijackedConn
+}
+
+func (w *httpResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *httpResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader || w.hijacked != nil {
+		return
+	}
+	w.wroteHeader = true
+
+	if !w.raw {
+		writeHTTPMessage(w.key, w.response, &common.HTTPMessage{Code: code, Headers: w.header})
+		return
+	}
+
+	// The proxy writes whatever is sent straight to the client's connection, so it has to be a
+	// complete HTTP response. Without a length the end of the body is the end of the connection.
+	w.header.Set("Connection", "close")
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	w.header.Write(buffer)
+	buffer.WriteString("\r\n")
+	writeHTTPMessage(w.key, w.response, &common.HTTPMessage{Body: buffer.Bytes()})
+}
+
+func (w *httpResponseWriter) Write(b []byte) (int, error) {
+	if w.hijacked != nil {
+		return 0, http.ErrHijacked
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	writeHTTPMessage(w.key, w.response, &common.HTTPMessage{Body: append([]byte(nil), b...)})
+	return len(b), nil
+}
+
+// Flush sends the headers if nothing has been written yet. Every Write is sent right away.
+func (w *httpResponseWriter) Flush() {
+	if !w.wroteHeader && w.hijacked == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Hijack hands the handler the client's connection, for requests the proxy hijacked itself.
+func (w *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !w.raw {
+		return nil, nil, errors.New("Request was not hijacked by the proxy")
+	}
+	if w.wroteHeader || w.hijacked != nil {
+		return nil, nil, http.ErrHijacked
+	}
+	w.hijacked = &hijackedConn{
+		key:      w.key,
+		response: w.response,
+		body:     w.body,
+		closed:   make(chan struct{}),
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(w.hijacked), bufio.NewWriter(w.hijacked))
+	return w.hijacked, rw, nil
+}
+
+// finish ends the response once the handler has returned. A hijacked connection ends when the
+// handler closes it.
+func (w *httpResponseWriter) finish() {
+	if w.hijacked != nil {
+		<-w.hijacked.closed
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.raw {
+		writeHTTPMessage(w.key, w.response, &common.HTTPMessage{EOF: true})
+	}
+}
+
+// hijackedConn is the client's connection as seen by a handler that hijacked it.
+type hijackedConn struct {
+	key       string
+	response  chan<- common.Message
+	body      *httpBodyReader
+	mu        sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *hijackedConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *hijackedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	writeHTTPMessage(c.key, c.response, &common.HTTPMessage{Body: append([]byte(nil), b...)})
+	return len(b), nil
+}
+
+func (c *hijackedConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *hijackedConn) LocalAddr() net.Addr {
+	return streamAddr(c.key)
+}
+
+func (c *hijackedConn) RemoteAddr() net.Addr {
+	return streamAddr(c.key)
+}
+
+func (c *hijackedConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *hijackedConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *hijackedConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func writeHTTPMessage(key string, response chan<- common.Message, message *common.HTTPMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.WithFields(log.Fields{"key": key, "error": err}).Error("Failed to encode HTTP message.")
+		return
+	}
+	response <- common.Message{Key: key, Type: common.Body, Body: string(data)}
+}
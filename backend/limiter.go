@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"sync"
+)
+
+// Limiter bounds how many streams an agent serves at once, so that a burst of requests such as
+// stats subscriptions can't exhaust it. Streams over a limit are refused with
+// common.CloseTooManyRequests, which frontends see as websocket close code 4429 or HTTP status 429.
+// Set it in Options; it keeps counting across reconnects.
+type Limiter struct {
+	// Max bounds the streams served at once across all handlers. Zero means no limit.
+	Max int
+	// PerHandler bounds the streams served at once by a handler, keyed by the path the handler was
+	// registered with. Handlers that aren't listed have no limit of their own.
+	PerHandler map[string]int
+
+	mu       sync.Mutex
+	active   int
+	rejected int64
+	handlers map[string]*HandlerStats
+}
+
+// LimiterStats are the counters of a Limiter.
+type LimiterStats struct {
+	// Active is the number of streams being served.
+	Active int
+	// Max is the global limit, or zero.
+	Max int
+	// Rejected is the number of streams refused because a limit was reached.
+	Rejected int64
+	// Handlers has the counters of each handler that has served or refused a stream.
+	Handlers map[string]HandlerStats
+}
+
+// HandlerStats are the counters of one handler.
+type HandlerStats struct {
+	Active   int
+	Max      int
+	Rejected int64
+}
+
+// acquire admits a stream for the handler registered with pattern, or returns the reason it was
+// refused.
+func (l *Limiter) acquire(pattern string) (string, bool) {
+	if l == nil {
+		return "", true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	handler := l.handler(pattern)
+	if handler.Max > 0 && handler.Active >= handler.Max {
+		l.rejected++
+		handler.Rejected++
+		return "too many streams for " + pattern, false
+	}
+	if l.Max > 0 && l.active >= l.Max {
+		l.rejected++
+		handler.Rejected++
+		return "too many streams", false
+	}
+	l.active++
+	handler.Active++
+	return "", true
+}
+
+// release ends a stream admitted by acquire.
+func (l *Limiter) release(pattern string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.handler(pattern).Active--
+}
+
+func (l *Limiter) handler(pattern string) *HandlerStats {
+	if l.handlers == nil {
+		l.handlers = make(map[string]*HandlerStats)
+	}
+	handler, ok := l.handlers[pattern]
+	if !ok {
+		handler = &HandlerStats{}
+		l.handlers[pattern] = handler
+	}
+	handler.Max = l.PerHandler[pattern]
+	return handler
+}
+
+// Stats returns a snapshot of the counters. A nil Limiter has nothing to count.
+func (l *Limiter) Stats() LimiterStats {
+	if l == nil {
+		return LimiterStats{Handlers: map[string]HandlerStats{}}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := LimiterStats{
+		Active:   l.active,
+		Max:      l.Max,
+		Rejected: l.rejected,
+		Handlers: make(map[string]HandlerStats, len(l.handlers)),
+	}
+	for pattern, handler := range l.handlers {
+		stats.Handlers[pattern] = *handler
+	}
+	return stats
+}
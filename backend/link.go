@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+// linkLost is the reason streams are closed with when the connection to the proxy is lost.
+var linkLost = common.CloseReason{Code: common.CloseGoingAway, Reason: "proxy disconnected"}
+
+// link is the state of one connection to the proxy that is shared between the goroutine reading
+// from it and Dialers opening streams on it.
+type link struct {
+	mu         sync.Mutex
+	responders map[string]*responder
+	proxy      *common.Handshake
+	scheduler  *common.Scheduler
+	fragmenter *common.Fragmenter
+	// draining is set once the agent has said it is going away, proxyGoingAway once the proxy has.
+	draining       bool
+	proxyGoingAway bool
+	// sessions, if set, keeps the streams of the link for the next one to resume when it is lost.
+	sessions *sessions
+}
+
+func newLink() *link {
+	return &link{
+		responders: make(map[string]*responder),
+		scheduler:  common.NewScheduler(),
+		fragmenter: &common.Fragmenter{},
+	}
+}
+
+func (l *link) get(msgKey string) (*responder, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r, ok := l.responders[msgKey]
+	return r, ok
+}
+
+func (l *link) add(r *responder) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.responders[r.key] = r
+}
+
+// remove forgets a stream without closing it.
+func (l *link) remove(msgKey string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.responders, msgKey)
+}
+
+// close closes a stream and forgets it.
+func (l *link) close(msgKey string, reason common.CloseReason) {
+	l.mu.Lock()
+	r, ok := l.responders[msgKey]
+	delete(l.responders, msgKey)
+	l.mu.Unlock()
+	if ok {
+		r.closeWithReason(reason)
+	}
+	l.scheduler.Forget(msgKey)
+}
+
+// release forgets a stream once its handler has returned and its responses have been sent.
+func (l *link) release(r *responder) {
+	<-r.forwardDone
+	l.mu.Lock()
+	current := l.responders[r.key] == r
+	l.mu.Unlock()
+	if current {
+		l.close(r.key, common.CloseReason{Code: common.CloseNormal})
+	}
+}
+
+// drain tells the proxy the agent is going away so that it stops opening streams, then waits for
+// the open streams to finish or ctx to be done.
+func (l *link) drain(ctx context.Context, reason string) error {
+	l.mu.Lock()
+	l.draining = true
+	l.mu.Unlock()
+	if l.supports(common.GoingAway) {
+		l.scheduler.Push(common.NewGoingAway(reason))
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for l.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (l *link) isDraining() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.draining
+}
+
+func (l *link) setProxyGoingAway() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.proxyGoingAway = true
+}
+
+func (l *link) isProxyGoingAway() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.proxyGoingAway
+}
+
+func (l *link) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.responders)
+}
+
+// closeAll closes every stream when the connection to the proxy is lost with err, telling handlers
+// that implement LinkLostHandler first. Streams that can be resumed are parked instead, unless the
+// connection was closed on purpose.
+func (l *link) closeAll(err error) {
+	resume := l.resumable() && !l.isDraining() && !l.isProxyGoingAway() &&
+		!websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+
+	l.mu.Lock()
+	responders := l.responders
+	l.responders = make(map[string]*responder)
+	l.mu.Unlock()
+	for _, r := range responders {
+		if resume && r.replay != nil && r.park() {
+			l.sessions.park(r)
+			continue
+		}
+		r.linkLost()
+	}
+	l.scheduler.Close()
+}
+
+// resumable reports whether streams opened on the link are kept for resuming it when it is lost.
+func (l *link) resumable() bool {
+	return l.sessions != nil && l.supports(common.Resume)
+}
+
+func (l *link) setProxy(handshake common.Handshake) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.proxy = &handshake
+}
+
+// supports reports whether the proxy said in its hello that it understands the message type.
+func (l *link) supports(messageType common.MessageType) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.proxy.Supports(messageType)
+}
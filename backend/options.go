@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+const (
+	defaultKeepAliveInterval = 5 * time.Second
+	defaultKeepAliveTimeout  = 10 * time.Second
+	pingWriteTimeout         = time.Second
+)
+
+// Options customize how a backend connects to the proxy. The zero value is what ConnectToProxy uses.
+type Options struct {
+	// AgentVersion is reported to the proxy in the hello sent on connect.
+	AgentVersion string
+	// Labels are reported to the proxy in the hello sent on connect.
+	Labels map[string]string
+	// MaxFrameSize is the largest body accepted from the proxy in one message. Larger bodies are
+	// fragmented by proxies that support it. Zero means common.DefaultMaxFrameSize.
+	MaxFrameSize int
+	// MaxMessageSize bounds bodies reassembled from fragments. Zero means
+	// common.DefaultMaxMessageSize.
+	MaxMessageSize int
+	// Limiter, if set, bounds how many streams are served at once.
+	Limiter *Limiter
+	// Dialer, if set, opens streams to destinations behind the proxy over this connection.
+	Dialer *Dialer
+	// DisableCompression stops the agent offering per-message deflate to the proxy.
+	DisableCompression bool
+	// CompressionLevel and CompressionThreshold are the common.Compression settings for messages
+	// sent to the proxy. Zero uses the defaults.
+	CompressionLevel     int
+	CompressionThreshold int
+	// CompressionStats, if set, counts the bytes sent and received when compression is negotiated.
+	CompressionStats *common.CompressionStats
+
+	// TLSConfig is used for wss:// proxies, for example to trust a private CA with RootCAs or to
+	// present a client certificate. Nil uses the system roots.
+	TLSConfig *tls.Config
+	// Headers are sent with the websocket handshake, for example an Authorization header carrying
+	// the token instead of the query string.
+	Headers http.Header
+	// Proxy returns the HTTP proxy to tunnel through with CONNECT, as http.Transport's Proxy does.
+	// Use http.ProxyFromEnvironment to honor HTTPS_PROXY. Nil connects directly.
+	Proxy func(*http.Request) (*url.URL, error)
+	// HandshakeTimeout bounds dialing the proxy and completing the websocket handshake. Zero means
+	// no timeout.
+	HandshakeTimeout time.Duration
+	// ReadTimeout closes the connection if nothing, not even a pong, is received from the proxy for
+	// this long. Zero means no timeout.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds each write to the proxy. Zero means no timeout.
+	WriteTimeout time.Duration
+	// KeepAliveInterval is how often the agent pings the proxy. Zero means five seconds.
+	KeepAliveInterval time.Duration
+	// KeepAliveTimeout closes the connection if the proxy hasn't answered a ping for this long.
+	// Zero means ten seconds.
+	KeepAliveTimeout time.Duration
+
+	// ResumeGracePeriod is how long a Client keeps the streams of a lost connection for the proxy to
+	// resume once it has reconnected. Handlers keep running meanwhile and see nothing of the
+	// reconnect. Zero closes the streams with the connection. ConnectToProxy doesn't reconnect and
+	// ignores it.
+	ResumeGracePeriod time.Duration
+	// ResumeBufferSize bounds the bytes of responses kept per stream to send again after resuming
+	// it. Zero means common.DefaultReplayBufferSize.
+	ResumeBufferSize int
+}
+
+func (o *Options) handshake() common.Handshake {
+	return common.Handshake{
+		Version:      common.ProtocolVersion,
+		AgentVersion: o.AgentVersion,
+		MessageTypes: common.SupportedMessageTypes(),
+		Labels:       o.Labels,
+		MaxFrameSize: o.maxFrameSize(),
+	}
+}
+
+func (o *Options) maxFrameSize() int {
+	if o.MaxFrameSize == 0 {
+		return common.DefaultMaxFrameSize
+	}
+	return o.MaxFrameSize
+}
+
+func (o *Options) maxMessageSize() int {
+	if o.MaxMessageSize == 0 {
+		return common.DefaultMaxMessageSize
+	}
+	return o.MaxMessageSize
+}
+
+func (o *Options) compression() *common.Compression {
+	if o.DisableCompression {
+		return nil
+	}
+	return &common.Compression{
+		Level:     o.CompressionLevel,
+		Threshold: o.CompressionThreshold,
+		Stats:     o.CompressionStats,
+	}
+}
+
+func (o *Options) keepAliveInterval() time.Duration {
+	if o.KeepAliveInterval <= 0 {
+		return defaultKeepAliveInterval
+	}
+	return o.KeepAliveInterval
+}
+
+func (o *Options) keepAliveTimeout() time.Duration {
+	if o.KeepAliveTimeout <= 0 {
+		return defaultKeepAliveTimeout
+	}
+	return o.KeepAliveTimeout
+}
+
+// deadline returns when an operation started now with the given timeout must finish, or the zero
+// time for no deadline.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
@@ -8,14 +8,15 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func newPongHandler(ws *websocket.Conn) *pongHandler {
+func newPongHandler(ws *websocket.Conn, opts Options) *pongHandler {
 	ph := &pongHandler{
-		mu:       &sync.Mutex{},
-		lastPing: time.Now(),
-		ws:       ws,
+		mu:          &sync.Mutex{},
+		lastPing:    time.Now(),
+		ws:          ws,
+		readTimeout: opts.ReadTimeout,
 	}
 
-	go ph.startTimer(5000, 10000)
+	go ph.startTimer(opts.keepAliveInterval(), opts.keepAliveTimeout())
 
 	return ph
 }
@@ -24,15 +25,17 @@ type pongHandler struct {
 	mu       *sync.Mutex
 	lastPing time.Time
 	ws       *websocket.Conn
+	// readTimeout is pushed back by every pong, so an idle but healthy link isn't timed out
+	readTimeout time.Duration
 }
 
-func (h *pongHandler) startTimer(checkInterval, maxWait int) {
-	ticker := time.NewTicker(time.Millisecond * time.Duration(checkInterval))
+func (h *pongHandler) startTimer(checkInterval, maxWait time.Duration) {
+	ticker := time.NewTicker(checkInterval)
 	defer ticker.Stop()
 	for range ticker.C {
 		h.mu.Lock()
 		t := h.lastPing
-		timeoutAt := t.Add(time.Millisecond * time.Duration(maxWait))
+		timeoutAt := t.Add(maxWait)
 		h.mu.Unlock()
 		if time.Now().After(timeoutAt) {
 			logrus.Warnf("Hit websocket pong timeout. Last websocket ping received at %v. Closing connection.", t)
@@ -46,5 +49,8 @@ func (h *pongHandler) handle(appData string) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.lastPing = time.Now()
+	if h.readTimeout > 0 {
+		h.ws.SetReadDeadline(deadline(h.readTimeout))
+	}
 	return nil
 }
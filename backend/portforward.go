@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+// PortForwardPattern is the path the proxy's FrontendPortForwardHandler opens streams to, with the
+// port named by the frontend's token. Register a PortForwardHandler for it:
+//
+//	handlers[backend.PortForwardPattern] = backend.HandleStream(&backend.PortForwardHandler{})
+const PortForwardPattern = "/v1/portforward/{port}"
+
+const defaultPortForwardTimeout = 10 * time.Second
+
+// PortForwardHandler connects each stream to a TCP port on the host and copies bytes both ways
+// until either side is done, like kubectl port-forward.
+type PortForwardHandler struct {
+	// Host is the address ports are dialed on. Empty means 127.0.0.1.
+	Host string
+	// Ports, if set, are the only ports that may be forwarded.
+	Ports []int
+	// DialTimeout bounds connecting to the port. Zero means ten seconds.
+	DialTimeout time.Duration
+}
+
+func (h *PortForwardHandler) ServeStream(ctx context.Context, stream *Stream) error {
+	port, err := strconv.Atoi(stream.Vars["port"])
+	if err != nil || port <= 0 || port > 65535 {
+		return stream.CloseWithReason(common.CloseNotFound, "invalid port "+stream.Vars["port"])
+	}
+	if !h.allowed(port) {
+		return stream.CloseWithReason(common.CloseForbidden, "port "+strconv.Itoa(port)+" may not be forwarded")
+	}
+
+	host := h.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	timeout := h.DialTimeout
+	if timeout == 0 {
+		timeout = defaultPortForwardTimeout
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		log.WithFields(log.Fields{"address": address, "error": err}).Warn("Failed to connect forwarded port.")
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return stream.CloseWithReason(common.CloseGatewayTimeout, err.Error())
+		}
+		return stream.CloseWithReason(common.CloseBadGateway, err.Error())
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	go func() {
+		io.Copy(conn, stream)
+		// The frontend is done sending, let the port see EOF but keep reading its response
+		if c, ok := conn.(interface {
+			CloseWrite() error
+		}); ok {
+			c.CloseWrite()
+		}
+	}()
+
+	io.Copy(stream, conn)
+	return nil
+}
+
+func (h *PortForwardHandler) allowed(port int) bool {
+	if len(h.Ports) == 0 {
+		return true
+	}
+	for _, p := range h.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
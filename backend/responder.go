@@ -0,0 +1,240 @@
+package backend
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+// responder connects one handler invocation to the proxy. Incoming bodies are queued and fed to
+// the handler by deliver(), and the handler's responses are forwarded by forward() as the proxy
+// grants credit, so a slow stream only holds up itself.
+type responder struct {
+	key        string
+	incoming   chan string
+	response   chan common.Message
+	sendWindow *common.SendWindow
+	recvWindow *common.ReceiveWindow
+	queue      *common.DeliveryQueue
+	halfClose  bool
+	lost       LinkLostHandler
+	// raw streams were opened by a Dialer. Their bodies aren't base64 encoded for a handler and
+	// accepted is closed once the proxy accepts them.
+	raw         bool
+	accepted    chan struct{}
+	closeReason common.CloseReason
+	forwardDone chan struct{}
+	done        chan struct{}
+	handlerDone chan struct{}
+	closeOnce   sync.Once
+	// out is the scheduler of the link the stream is on and fragmenter splits responses for it.
+	// Both are nil while the stream is parked, waiting to be resumed on a new link.
+	outMu      sync.Mutex
+	out        *common.Scheduler
+	fragmenter *common.Fragmenter
+	// replay keeps the responses sent so that the stream can be resumed, it is nil for streams that
+	// can't be. received counts the sequenced messages from the proxy, attached is the link the
+	// stream is being resumed on and resumed gets the proxy's answer. finished is set once forward
+	// has sent everything and the stream can no longer be parked.
+	replay   *common.ReplayBuffer
+	received uint64
+	attached *link
+	resumed  chan resumption
+	finished bool
+}
+
+func newResponder(key string, fragmenter *common.Fragmenter) *responder {
+	return &responder{
+		key:         key,
+		fragmenter:  fragmenter,
+		incoming:    make(chan string, 10),
+		response:    make(chan common.Message, 10),
+		sendWindow:  common.NewSendWindow(),
+		recvWindow:  common.NewReceiveWindow(common.DefaultWindowSize),
+		queue:       common.NewDeliveryQueue(),
+		done:        make(chan struct{}),
+		handlerDone: make(chan struct{}),
+		forwardDone: make(chan struct{}),
+		resumed:     make(chan resumption, 1),
+	}
+}
+
+func (r *responder) serve(handler Handler, initialMessage string, vars map[string]string, out *common.Scheduler) {
+	if h, ok := handler.(LinkLostHandler); ok {
+		r.lost = h
+	}
+	if h, ok := handler.(*streamHandler); ok {
+		r.raw = true
+		r.start(out)
+		go r.serveStream(h.handler, initialMessage, vars)
+		return
+	}
+	r.start(out)
+	go func() {
+		defer close(r.handlerDone)
+		if h, ok := handler.(VarsHandler); ok {
+			h.HandleVars(r.key, initialMessage, vars, r.incoming, r.response)
+		} else {
+			handler.Handle(r.key, initialMessage, r.incoming, r.response)
+		}
+	}()
+}
+
+// serveStream runs a StreamHandler and closes the stream when it returns.
+func (r *responder) serveStream(handler StreamHandler, initialMessage string, vars map[string]string) {
+	defer close(r.handlerDone)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stream := &Stream{Key: r.key, Vars: vars, r: r}
+	stream.URL, _ = url.Parse(initialMessage)
+	if err := handler.ServeStream(ctx, stream); err != nil {
+		stream.CloseWithReason(common.CloseInternalError, err.Error())
+	} else {
+		stream.Close()
+	}
+}
+
+// start delivers incoming bodies and forwards responses. serve starts the handler as well, streams
+// opened by a Dialer close handlerDone when the connection is closed.
+func (r *responder) start(out *common.Scheduler) {
+	r.outMu.Lock()
+	r.out = out
+	r.outMu.Unlock()
+	go r.deliver()
+	go r.forward()
+}
+
+// scheduler returns the scheduler of the link the stream is on, or nil while it is parked.
+func (r *responder) scheduler() *common.Scheduler {
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+	return r.out
+}
+
+// isAccepted reports whether the responder is for a stream the agent opened that the proxy accepted.
+func (r *responder) isAccepted() bool {
+	if r.accepted == nil {
+		return false
+	}
+	select {
+	case <-r.accepted:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueue queues a body from the proxy for the handler. It only blocks if the proxy doesn't do
+// flow control and the handler is behind.
+func (r *responder) enqueue(message common.Message, credit int) {
+	r.queue.Push(message, credit, r.sendWindow.Enabled(), r.done, nil)
+}
+
+// deliver feeds queued bodies to the handler and returns credit to the proxy as they are
+// consumed. The handler's incoming channel is closed when the responder is closed, or after the
+// last body if the frontend half-closes the stream.
+func (r *responder) deliver() {
+	defer close(r.incoming)
+	for {
+		queued, ok := r.queue.Next(r.done)
+		if !ok {
+			return
+		}
+		if queued.Message.Type == common.WriteDone || queued.Message.Type == common.Close {
+			// The other side is done sending, this side can still respond
+			return
+		}
+
+		select {
+		case r.incoming <- r.body(queued.Message):
+		case <-r.done:
+			return
+		}
+		r.queue.Delivered()
+		r.credit(r.scheduler(), queued.Credit)
+	}
+}
+
+// credit counts n body bytes as consumed, returning credit to the proxy when enough have been.
+// Credit is dropped while the stream is parked, the window starts over when it is resumed.
+func (r *responder) credit(out *common.Scheduler, n int) {
+	if n := r.recvWindow.Consume(n); n > 0 && out != nil {
+		out.Push(common.NewWindowUpdate(r.key, n))
+	}
+}
+
+func (r *responder) body(message common.Message) string {
+	if r.raw {
+		return message.Body
+	}
+	return legacyBody(message)
+}
+
+// forward passes the handler's responses on to the proxy until the handler returns, and resumes
+// the stream on a new link if the one it was on is lost.
+func (r *responder) forward() {
+	defer close(r.forwardDone)
+	for {
+		select {
+		case message := <-r.response:
+			r.forwardMessage(message)
+		case resumed := <-r.resumed:
+			r.resumeOn(resumed)
+		case <-r.handlerDone:
+			for {
+				select {
+				case message := <-r.response:
+					r.forwardMessage(message)
+				default:
+					r.awaitResume()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *responder) forwardMessage(message common.Message) {
+	if r.replay != nil && common.Sequenced(message.Type) {
+		r.replay.Add(message)
+	}
+	r.push(message)
+}
+
+// push fragments a message for the link the stream is on and queues it as the proxy grants credit.
+// Nothing is sent while the stream is parked.
+func (r *responder) push(message common.Message) {
+	r.outMu.Lock()
+	out, fragmenter := r.out, r.fragmenter
+	r.outMu.Unlock()
+	if out == nil {
+		return
+	}
+
+	for _, message := range fragmenter.Split(message) {
+		body := message.Type == common.Body || message.Type == common.Fragment
+		if body && !r.sendWindow.Acquire(len(message.Body)) {
+			// The stream is closed, nobody is listening for this any more
+			return
+		}
+		out.Push(message)
+	}
+}
+
+func (r *responder) closeWithReason(reason common.CloseReason) {
+	r.closeOnce.Do(func() {
+		r.closeReason = reason
+		close(r.done)
+		r.sendWindow.Close()
+	})
+}
@@ -0,0 +1,208 @@
+package backend
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+// sessions keeps the streams of a Client's lost connection for the next connection to resume, see
+// Options.ResumeGracePeriod.
+type sessions struct {
+	mu         sync.Mutex
+	grace      time.Duration
+	bufferSize int
+	parked     map[string]*parkedResponder
+}
+
+// parkedResponder is a stream waiting for a new connection, closed when timer fires.
+type parkedResponder struct {
+	r     *responder
+	timer *time.Timer
+}
+
+// resumption is the proxy's answer to a Resume: the link the stream was resumed on and how many
+// sequenced messages the proxy had received.
+type resumption struct {
+	l        *link
+	received uint64
+}
+
+// newSessions returns nil if streams aren't resumed.
+func newSessions(opts Options) *sessions {
+	if opts.ResumeGracePeriod <= 0 {
+		return nil
+	}
+	return &sessions{
+		grace:      opts.ResumeGracePeriod,
+		bufferSize: opts.ResumeBufferSize,
+		parked:     make(map[string]*parkedResponder),
+	}
+}
+
+// park keeps a stream until it is taken by the next connection, closing it if there is none within
+// the grace period.
+func (s *sessions) park(r *responder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parked[r.key] = &parkedResponder{
+		r: r,
+		timer: time.AfterFunc(s.grace, func() {
+			s.mu.Lock()
+			_, ok := s.parked[r.key]
+			delete(s.parked, r.key)
+			s.mu.Unlock()
+			if ok {
+				log.WithFields(log.Fields{"key": r.key, "gracePeriod": s.grace}).Info("Stream was not resumed in time, closing it.")
+				r.linkLost()
+			}
+		}),
+	}
+}
+
+// take returns the parked streams and forgets them.
+func (s *sessions) take() []*responder {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var responders []*responder
+	for key, p := range s.parked {
+		p.timer.Stop()
+		delete(s.parked, key)
+		responders = append(responders, p.r)
+	}
+	return responders
+}
+
+// close closes the parked streams, once the Client stops reconnecting.
+func (s *sessions) close() {
+	for _, r := range s.take() {
+		r.linkLost()
+	}
+}
+
+// resumeParked asks the proxy to resume the streams parked when the previous connection was lost,
+// once its hello says whether it can. Each is told how many messages were received on the stream
+// and granted a new window.
+func (l *link) resumeParked(supported bool) {
+	for _, r := range l.sessions.take() {
+		if !supported {
+			r.linkLost()
+			continue
+		}
+		r.attach(l)
+		l.add(r)
+		r.recvWindow.Reset()
+		l.scheduler.Push(common.NewResume(r.key, atomic.LoadUint64(&r.received)))
+		l.scheduler.Push(common.NewWindowUpdate(r.key, r.recvWindow.Size()))
+		go l.release(r)
+	}
+}
+
+// resumed passes the proxy's answer to a Resume on to forward, which sends what the proxy missed.
+func (l *link) resumed(r *responder, message common.Message) error {
+	received, err := common.ParseResume(message)
+	if err != nil {
+		return err
+	}
+	// The proxy grants a new window right after, forget what was left of the old one
+	r.sendWindow.Reset()
+	select {
+	case <-r.resumed:
+	default:
+	}
+	r.resumed <- resumption{l: l, received: received}
+	return nil
+}
+
+// countReceived counts a sequenced message from the proxy, see common.Resume.
+func (r *responder) countReceived() {
+	if r.replay != nil {
+		atomic.AddUint64(&r.received, 1)
+	}
+}
+
+// park detaches the stream from a link that was lost. Responses are only kept for the proxy until
+// the stream is resumed. It returns false if forward has already finished, in which case the
+// stream can't be resumed.
+func (r *responder) park() bool {
+	r.sendWindow.Suspend()
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+	if r.finished {
+		return false
+	}
+	r.out, r.fragmenter, r.attached = nil, nil, nil
+	return true
+}
+
+// attach marks the stream as being resumed on l. It stays parked until the proxy answers.
+func (r *responder) attach(l *link) {
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+	r.attached = l
+}
+
+// resumeOn moves the stream to the link the proxy resumed it on and sends what the proxy missed.
+// It runs on forward's goroutine so that nothing the handler sends meanwhile gets ahead of it.
+func (r *responder) resumeOn(resumed resumption) {
+	missing, err := r.replay.Since(resumed.received)
+	if err != nil {
+		log.WithFields(log.Fields{"key": r.key, "error": err}).Warn("Failed to resume stream.")
+		resumed.l.close(r.key, linkLost)
+		resumed.l.scheduler.Push(common.NewClose(r.key, common.CloseGoingAway, "stream could not be resumed"))
+		return
+	}
+
+	r.outMu.Lock()
+	if r.attached != resumed.l {
+		// The link was lost again before the proxy answered
+		r.outMu.Unlock()
+		return
+	}
+	r.out, r.fragmenter = resumed.l.scheduler, resumed.l.fragmenter
+	r.outMu.Unlock()
+
+	log.WithFields(log.Fields{"key": r.key, "replayed": len(missing)}).Debug("Resumed stream.")
+	for _, message := range missing {
+		r.push(message)
+	}
+}
+
+// awaitResume is called once the handler has returned and its responses have been sent. If the
+// stream is parked, what is left to send has to wait for it to be resumed.
+func (r *responder) awaitResume() {
+	if r.replay == nil {
+		return
+	}
+	for {
+		r.outMu.Lock()
+		if r.out != nil {
+			r.finished = true
+			r.outMu.Unlock()
+			return
+		}
+		r.outMu.Unlock()
+
+		select {
+		case resumed := <-r.resumed:
+			r.resumeOn(resumed)
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// linkLost closes a stream whose link is gone for good.
+func (r *responder) linkLost() {
+	if r.lost != nil {
+		r.lost.LinkLost(r.key)
+	}
+	r.closeWithReason(linkLost)
+}
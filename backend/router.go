@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"sort"
+	"strings"
+)
+
+// router matches request paths to the handlers given to ConnectToProxy. Handler paths are
+// templates whose segments are either literal or a variable such as {containerId}, which matches
+// any one segment. A template matches a path it is a prefix of, segment by segment, so
+// "/v1/stats/" matches "/v1/stats/1234". When several match, the one with the most segments wins,
+// then the one with a literal where the others have a variable, so the choice never depends on map
+// order.
+type router struct {
+	routes []route
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	handler  Handler
+}
+
+func newRouter(handlers map[string]Handler) *router {
+	r := &router{}
+	for pattern, handler := range handlers {
+		r.routes = append(r.routes, route{
+			pattern:  pattern,
+			segments: splitPath(pattern),
+			handler:  handler,
+		})
+	}
+	sort.Slice(r.routes, func(i, j int) bool {
+		return r.routes[i].before(r.routes[j])
+	})
+	return r
+}
+
+// match returns the most specific route for path and the variables its template extracted.
+func (r *router) match(path string) (*route, map[string]string, bool) {
+	segments := splitPath(path)
+	for i := range r.routes {
+		if vars, ok := r.routes[i].match(segments); ok {
+			return &r.routes[i], vars, true
+		}
+	}
+	return nil, nil, false
+}
+
+func (r route) match(segments []string) (map[string]string, bool) {
+	if len(r.segments) > len(segments) {
+		return nil, false
+	}
+	vars := map[string]string{}
+	for i, segment := range r.segments {
+		if name, ok := variable(segment); ok {
+			vars[name] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+// before reports whether r is more specific than other and should be tried first.
+func (r route) before(other route) bool {
+	if len(r.segments) != len(other.segments) {
+		return len(r.segments) > len(other.segments)
+	}
+	for i := range r.segments {
+		_, rVar := variable(r.segments[i])
+		_, otherVar := variable(other.segments[i])
+		if rVar != otherVar {
+			return otherVar
+		}
+	}
+	return r.pattern < other.pattern
+}
+
+func variable(segment string) (string, bool) {
+	if len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,205 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+// StreamHandler is the io based alternative to Handler. ServeStream is called for each stream with
+// a context that is canceled when the stream is closed or the connection to the proxy is lost.
+// Bodies are passed through as they are, binary or not. The stream is closed when ServeStream
+// returns, with an internal error close code if it returns an error.
+type StreamHandler interface {
+	ServeStream(ctx context.Context, stream *Stream) error
+}
+
+// StreamHandlerFunc lets an ordinary function be a StreamHandler.
+type StreamHandlerFunc func(ctx context.Context, stream *Stream) error
+
+func (f StreamHandlerFunc) ServeStream(ctx context.Context, stream *Stream) error {
+	return f(ctx, stream)
+}
+
+// HandleStream adapts a StreamHandler so it can be registered in the same handlers map as legacy
+// Handlers.
+func HandleStream(handler StreamHandler) Handler {
+	return &streamHandler{handler: handler}
+}
+
+type streamHandler struct {
+	handler StreamHandler
+}
+
+// Handle only exists to satisfy Handler, streams for a streamHandler are served by serveStream.
+func (h *streamHandler) Handle(key string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message) {
+	SignalHandlerClosedWithReason(key, response, common.CloseInternalError, "stream handler called as a legacy handler")
+}
+
+// SupportsHalfClose is true because Read returns io.EOF when the frontend is done sending while
+// the stream stays open for writing.
+func (h *streamHandler) SupportsHalfClose() bool {
+	return true
+}
+
+// Stream is one stream over the connection to the proxy, either from a frontend to a StreamHandler
+// or opened by a Dialer. It is a net.Conn.
+type Stream struct {
+	// Key identifies the stream on the connection to the proxy.
+	Key string
+	// URL is the URL the frontend requested. It is nil for streams opened by a Dialer.
+	URL *url.URL
+	// Vars are the variables matched by the handler's path, see VarsHandler.
+	Vars map[string]string
+
+	link        *link
+	r           *responder
+	destination string
+	buffer      []byte
+	mu          sync.Mutex
+	deadline    time.Time
+	closeOnce   sync.Once
+	writeOnce   sync.Once
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	if len(s.buffer) == 0 {
+		var timeout <-chan time.Time
+		if deadline := s.readDeadline(); !deadline.IsZero() {
+			timer := time.NewTimer(deadline.Sub(time.Now()))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case body, ok := <-s.r.incoming:
+			if !ok {
+				return 0, s.readError()
+			}
+			s.buffer = []byte(body)
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+	}
+
+	n := copy(b, s.buffer)
+	s.buffer = s.buffer[n:]
+	return n, nil
+}
+
+// readError is why there is nothing more to read: the other side closed the stream or finished
+// writing, or the connection to the proxy was lost.
+func (s *Stream) readError() error {
+	select {
+	case <-s.r.done:
+		if s.r.closeReason == linkLost {
+			return ErrLinkLost
+		}
+	default:
+	}
+	return io.EOF
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	message := common.Message{Key: s.Key, Type: common.Body, Body: string(b), Binary: true}
+	select {
+	case s.r.response <- message:
+		return len(b), nil
+	case <-s.r.handlerDone:
+		return 0, io.ErrClosedPipe
+	case <-s.r.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// CloseWrite tells the other side nothing more will be written, like TCPConn.CloseWrite.
+func (s *Stream) CloseWrite() error {
+	s.writeOnce.Do(func() {
+		select {
+		case s.r.response <- common.Message{Key: s.Key, Type: common.WriteDone}:
+		case <-s.r.done:
+		}
+	})
+	return nil
+}
+
+// Close closes the stream after what was written has been sent.
+func (s *Stream) Close() error {
+	return s.CloseWithReason(common.CloseNormal, "")
+}
+
+// CloseWithReason closes the stream with one of the common.Close* codes and a reason, which the
+// proxy passes on to the frontend.
+func (s *Stream) CloseWithReason(code int, reason string) error {
+	s.closeOnce.Do(func() {
+		select {
+		case s.r.response <- common.NewClose(s.Key, code, reason):
+		case <-s.r.done:
+		}
+		if s.link == nil {
+			// The stream's handler is still running, serveStream finishes up when it returns
+			return
+		}
+		close(s.r.handlerDone)
+		go func() {
+			<-s.r.forwardDone
+			s.link.close(s.Key, common.CloseReason{Code: common.CloseNormal})
+		}()
+	})
+	return nil
+}
+
+func (s *Stream) readDeadline() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deadline
+}
+
+// SetDeadline only applies to reads, writes are bounded by flow control instead.
+func (s *Stream) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetReadDeadline applies to the next Read that has to wait.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadline = t
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return streamAddr(s.Key)
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	if s.URL != nil {
+		return streamAddr(s.URL.String())
+	}
+	return streamAddr(s.destination)
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string {
+	return "websocket-proxy"
+}
+
+func (a streamAddr) String() string {
+	return string(a)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
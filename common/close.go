@@ -0,0 +1,94 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Close codes carried by Close messages. They share the websocket close code space so that a
+// frontend websocket can be closed with the code as is: the 1000 range are the standard websocket
+// codes and everything else is 4000 plus the HTTP status code that best describes it.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseInternalError   = 1011
+	CloseForbidden       = 4000 + http.StatusForbidden
+	CloseNotFound        = 4000 + http.StatusNotFound
+	CloseTooManyRequests = 4000 + http.StatusTooManyRequests
+	CloseBadGateway      = 4000 + http.StatusBadGateway
+	CloseUnavailable     = 4000 + http.StatusServiceUnavailable
+	CloseGatewayTimeout  = 4000 + http.StatusGatewayTimeout
+)
+
+// CloseReason is the body of a Close message. Older peers send Close messages with an empty body,
+// which means a normal close.
+type CloseReason struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewClose builds a Close message carrying a code and a human readable reason.
+func NewClose(msgKey string, code int, reason string) Message {
+	message := Message{
+		Key:  msgKey,
+		Type: Close,
+	}
+	if code != CloseNormal || reason != "" {
+		data, _ := json.Marshal(CloseReason{Code: code, Reason: reason})
+		message.Body = string(data)
+	}
+	return message
+}
+
+// ParseClose returns the reason carried by a Close message. Bodies that can't be parsed are
+// treated as a normal close, just as an empty body is.
+func ParseClose(message Message) CloseReason {
+	reason := CloseReason{Code: CloseNormal}
+	if message.Body != "" {
+		if err := json.Unmarshal([]byte(message.Body), &reason); err != nil || reason.Code == 0 {
+			reason = CloseReason{Code: CloseNormal}
+		}
+	}
+	return reason
+}
+
+// NewGoingAway builds the GoingAway message a side sends when it starts shutting down.
+func NewGoingAway(reason string) Message {
+	return Message{Type: GoingAway, Body: reason}
+}
+
+// Error lets a CloseReason be returned as the error for a stream that couldn't be opened.
+func (c CloseReason) Error() string {
+	return c.Reason
+}
+
+// Normal reports whether the stream ended normally.
+func (c CloseReason) Normal() bool {
+	return c.Code == CloseNormal
+}
+
+// HTTPStatus maps the close code to an HTTP status code, or 0 for a normal close.
+func (c CloseReason) HTTPStatus() int {
+	switch {
+	case c.Code == CloseNormal:
+		return 0
+	case c.Code == CloseGoingAway:
+		return http.StatusServiceUnavailable
+	case c.Code == CloseProtocolError:
+		return http.StatusBadGateway
+	case c.Code >= 4100 && c.Code < 4600:
+		return c.Code - 4000
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// WebsocketCode is the code to close a frontend websocket with.
+func (c CloseReason) WebsocketCode() int {
+	if c.Code == CloseNormal || c.Code == CloseGoingAway || c.Code == CloseProtocolError ||
+		c.Code == CloseInternalError || (c.Code >= 4000 && c.Code < 5000) {
+		return c.Code
+	}
+	return CloseInternalError
+}
@@ -0,0 +1,27 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCloseRoundTrip(t *testing.T) {
+	message := NewClose("key", CloseNotFound, "handler missing")
+	reason := ParseClose(message)
+	if reason.Code != CloseNotFound || reason.Reason != "handler missing" {
+		t.Fatalf("Unexpected close reason: %+v", reason)
+	}
+	if reason.HTTPStatus() != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %v", reason.HTTPStatus())
+	}
+}
+
+func TestLegacyCloseIsNormal(t *testing.T) {
+	reason := ParseClose(Message{Key: "key", Type: Close})
+	if !reason.Normal() || reason.HTTPStatus() != 0 || reason.WebsocketCode() != CloseNormal {
+		t.Fatalf("Expected an empty close to be normal: %+v", reason)
+	}
+	if body := NewClose("key", CloseNormal, "").Body; body != "" {
+		t.Fatalf("Expected a normal close to keep an empty body, got %q", body)
+	}
+}
@@ -13,28 +13,78 @@ const (
 type MessageType string
 
 const (
-	Connect MessageType = "0"
-	Body    MessageType = "1"
-	Close   MessageType = "2"
+	Connect      MessageType = "0"
+	Body         MessageType = "1"
+	Close        MessageType = "2"
+	WindowUpdate MessageType = "3"
+	Hello        MessageType = "4"
+	Fragment     MessageType = "5"
+	// WriteDone tells the peer that no more bodies will be sent for the key in this direction.
+	// The stream stays open for the other direction until a Close.
+	WriteDone MessageType = "6"
+	// ReverseConnect opens a stream from a backend to the destination named in the body. The
+	// proxy accepts it with a WindowUpdate or refuses it with a Close.
+	ReverseConnect MessageType = "7"
+	// GoingAway tells the peer that the sender is shutting down. It has no key and its body is a
+	// human readable reason. No new streams should be opened and open streams are given a grace
+	// period to finish before the link is closed.
+	GoingAway MessageType = "8"
+	// Resume moves a stream to a new link after the link it was on was lost, see NewResume.
+	Resume MessageType = "9"
 )
 
+// SupportedMessageTypes lists the message types this version of the protocol understands. It is
+// advertised in the Hello exchanged when a backend connects.
+func SupportedMessageTypes() []MessageType {
+	return []MessageType{Connect, Body, Close, WindowUpdate, Hello, Fragment, WriteDone, ReverseConnect, GoingAway, Resume}
+}
+
 func FormatMessage(msgKey string, messageType MessageType, body string) string {
 	return fmt.Sprintf(MessageFormat, msgKey, messageType, body)
 }
 
-func ParseMessage(rawMessage string) Message {
-	parts := strings.SplitN(string(rawMessage), MessageSeparator, 3)
-	return Message{
+// ParseMessage parses a message in the text format. It returns an error for anything that isn't a
+// valid message, see ValidateMessage.
+func ParseMessage(rawMessage string) (Message, error) {
+	parts := strings.SplitN(rawMessage, MessageSeparator, 3)
+	if len(parts) != 3 {
+		return Message{}, fmt.Errorf("Malformed message: expected %v separated key, type and body", MessageSeparator)
+	}
+	message := Message{
 		Key:  parts[0],
 		Type: MessageType(parts[1]),
 		Body: parts[2],
 	}
+	return message, ValidateMessage(message)
+}
+
+// ValidateMessage checks that a message has a type this version of the protocol understands and a
+// key, which only a Hello or GoingAway may omit.
+func ValidateMessage(message Message) error {
+	if !supported(message.Type) {
+		return fmt.Errorf("Unknown message type %q", message.Type)
+	}
+	if message.Key == "" && message.Type != Hello && message.Type != GoingAway {
+		return fmt.Errorf("Missing key for message of type %v", message.Type)
+	}
+	return nil
+}
+
+func supported(messageType MessageType) bool {
+	for _, t := range SupportedMessageTypes() {
+		if t == messageType {
+			return true
+		}
+	}
+	return false
 }
 
 type Message struct {
 	Key  string
 	Type MessageType
 	Body string
+	// Binary marks a body holding raw bytes. The text format carries such bodies base64 encoded.
+	Binary bool
 }
 
 type HTTPMessage struct {
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	message, err := ParseMessage("key||1||a||b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Key != "key" || message.Type != Body || message.Body != "a||b" {
+		t.Fatalf("Unexpected message: %#v", message)
+	}
+
+	if _, err := ParseMessage("||4||{}"); err != nil {
+		t.Fatalf("Expected a hello without a key to be valid: %v", err)
+	}
+}
+
+func TestParseMessageRejectsInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"key",
+		"key||1",
+		"key||z||body",
+		"key||||body",
+		"||1||body",
+	}
+	for _, raw := range invalid {
+		if message, err := ParseMessage(raw); err == nil {
+			t.Errorf("Expected %q to be rejected, got %#v", raw, message)
+		}
+	}
+}
+
+// TestParseMessageCorpus checks that every message in the corpus that parses formats back to
+// itself. Each file in testdata/parse_message holds one Go quoted message, so that invalid UTF-8
+// and control bytes stay readable.
+func TestParseMessageCorpus(t *testing.T) {
+	corpus := []string{
+		"key||0||ws://host/v1/logs/",
+		"key||1||body",
+		"||4||{}",
+	}
+	dir := filepath.Join("testdata", "parse_message")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		raw, err := readCorpusString(filepath.Join(dir, file.Name()))
+		if err != nil {
+			t.Fatalf("Failed to read corpus file %v: %v", file.Name(), err)
+		}
+		corpus = append(corpus, raw)
+	}
+
+	for _, raw := range corpus {
+		message, err := ParseMessage(raw)
+		if err != nil {
+			continue
+		}
+		if formatted := FormatMessage(message.Key, message.Type, message.Body); formatted != raw {
+			t.Errorf("Expected %q to format back to itself, got %q", raw, formatted)
+		}
+	}
+}
+
+// readCorpusString reads a corpus file holding a single quoted string.
+func readCorpusString(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Unquote(strings.TrimSpace(string(contents)))
+}
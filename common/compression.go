@@ -0,0 +1,142 @@
+package common
+
+import (
+	"compress/flate"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultCompressionLevel favors speed, the links mostly carry logs and stats as they happen.
+	DefaultCompressionLevel = flate.BestSpeed
+	// DefaultCompressionThreshold is the smallest message worth compressing.
+	DefaultCompressionThreshold = 512
+)
+
+// Compression configures permessage-deflate for the messages written to a websocket. It only takes
+// effect if the peer negotiated the extension during the handshake. A nil *Compression sends
+// everything uncompressed.
+type Compression struct {
+	// Level is a compress/flate level. Zero means DefaultCompressionLevel.
+	Level int
+	// Threshold is the size in bytes below which messages are sent uncompressed. Zero means
+	// DefaultCompressionThreshold.
+	Threshold int
+	// Stats, if set, counts the bytes sent and received on compressed links.
+	Stats *CompressionStats
+}
+
+// Negotiated reports whether a websocket handshake with the given response (or, on the server,
+// request) headers agreed on permessage-deflate.
+func Negotiated(header http.Header) bool {
+	return strings.Contains(strings.ToLower(header.Get("Sec-Websocket-Extensions")), "permessage-deflate")
+}
+
+// Start configures a websocket whose handshake has just completed and, if it negotiated
+// compression, starts counting its bytes. It must be called before the websocket is used.
+func (c *Compression) Start(ws *websocket.Conn, negotiated bool) error {
+	if c == nil || !negotiated {
+		return nil
+	}
+	level := c.Level
+	if level == 0 {
+		level = DefaultCompressionLevel
+	}
+	if err := ws.SetCompressionLevel(level); err != nil {
+		return err
+	}
+	if conn, ok := ws.UnderlyingConn().(*CountingConn); ok && c.Stats != nil {
+		conn.stats = c.Stats
+	}
+	return nil
+}
+
+// WriteMessage writes a message, compressing it if it is at least the threshold in size.
+func (c *Compression) WriteMessage(ws *websocket.Conn, msgType int, data []byte) error {
+	if c == nil {
+		return ws.WriteMessage(msgType, data)
+	}
+	threshold := c.Threshold
+	if threshold == 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	ws.EnableWriteCompression(len(data) >= threshold)
+	if c.counting(ws) {
+		atomic.AddInt64(&c.Stats.payloadOut, int64(len(data)))
+	}
+	return ws.WriteMessage(msgType, data)
+}
+
+// ReadMessage reads a message, counting its decompressed size.
+func (c *Compression) ReadMessage(ws *websocket.Conn) (int, []byte, error) {
+	msgType, data, err := ws.ReadMessage()
+	if err == nil && c.counting(ws) {
+		atomic.AddInt64(&c.Stats.payloadIn, int64(len(data)))
+	}
+	return msgType, data, err
+}
+
+func (c *Compression) counting(ws *websocket.Conn) bool {
+	if c == nil {
+		return false
+	}
+	conn, ok := ws.UnderlyingConn().(*CountingConn)
+	return ok && conn.stats != nil
+}
+
+// CompressionStats counts message bytes against the bytes that went over the wire for them on
+// links that negotiated compression. It is safe for concurrent use.
+type CompressionStats struct {
+	payloadIn, payloadOut int64
+	wireIn, wireOut       int64
+}
+
+// CompressionCounts is a snapshot of CompressionStats.
+type CompressionCounts struct {
+	PayloadIn  int64 `json:"payloadIn"`
+	PayloadOut int64 `json:"payloadOut"`
+	WireIn     int64 `json:"wireIn"`
+	WireOut    int64 `json:"wireOut"`
+}
+
+// Counts returns the current counts.
+func (s *CompressionStats) Counts() CompressionCounts {
+	return CompressionCounts{
+		PayloadIn:  atomic.LoadInt64(&s.payloadIn),
+		PayloadOut: atomic.LoadInt64(&s.payloadOut),
+		WireIn:     atomic.LoadInt64(&s.wireIn),
+		WireOut:    atomic.LoadInt64(&s.wireOut),
+	}
+}
+
+// Saved is the number of bytes compression kept off the wire. Websocket framing (and TLS, for
+// agents dialing wss) counts against it.
+func (c CompressionCounts) Saved() int64 {
+	return c.PayloadIn + c.PayloadOut - c.WireIn - c.WireOut
+}
+
+// CountingConn counts the bytes read and written through it once a Compression starts counting.
+type CountingConn struct {
+	net.Conn
+	stats *CompressionStats
+}
+
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.stats != nil {
+		atomic.AddInt64(&c.stats.wireIn, int64(n))
+	}
+	return n, err
+}
+
+func (c *CountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.stats != nil {
+		atomic.AddInt64(&c.stats.wireOut, int64(n))
+	}
+	return n, err
+}
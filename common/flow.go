@@ -0,0 +1,265 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultWindowSize is the number of body bytes a side may have in flight for one stream before
+// it has to wait for the receiver to grant more credit.
+const DefaultWindowSize = 256 * 1024
+
+// LegacyQueueLength bounds the messages a DeliveryQueue buffers for a stream whose peer doesn't do
+// flow control. Reading from the link blocks while it is full, as it did before flow control.
+const LegacyQueueLength = 10
+
+// ErrDeliveryTimeout is returned by DeliveryQueue.Push when the reader didn't make room in time.
+var ErrDeliveryTimeout = errors.New("Timed out waiting for room in the delivery queue")
+
+// Flow control is opt-in per message key: a side that supports it sends a WindowUpdate for a
+// stream as soon as the stream exists. A sender only enforces credit once it has received a
+// WindowUpdate for the key, so peers that never send one keep the old, unlimited behavior.
+// A sender that already knows its peer does flow control (a backend on a binary framed link)
+// calls Require so that it waits for the first grant instead of sending ahead of it.
+
+// NewWindowUpdate builds the message granting the peer n more bytes of credit for msgKey.
+func NewWindowUpdate(msgKey string, n int) Message {
+	return Message{
+		Key:  msgKey,
+		Type: WindowUpdate,
+		Body: strconv.Itoa(n),
+	}
+}
+
+// ParseWindowUpdate returns the credit granted by a WindowUpdate message.
+func ParseWindowUpdate(message Message) (int, error) {
+	n, err := strconv.Atoi(message.Body)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid window update %q", message.Body)
+	}
+	return n, nil
+}
+
+// SendWindow tracks the credit the peer has granted for sending on one stream.
+type SendWindow struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	enabled   bool
+	granted   bool
+	closed    bool
+	suspended bool
+	credit    int
+}
+
+func NewSendWindow() *SendWindow {
+	w := &SendWindow{}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// Grant adds credit from a WindowUpdate. It returns true for the first grant, which is the
+// peer's signal that it does flow control for this stream.
+func (w *SendWindow) Grant(n int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	first := !w.granted
+	w.enabled = true
+	w.granted = true
+	w.credit += n
+	w.cond.Broadcast()
+	return first
+}
+
+// Require enforces credit before the first grant arrives.
+func (w *SendWindow) Require() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enabled = true
+}
+
+// Enabled reports whether the peer does flow control for this stream.
+func (w *SendWindow) Enabled() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enabled
+}
+
+// Acquire blocks until there is credit to send n bytes and takes it. A message larger than the
+// remaining credit is let through as soon as any credit is available so that it can't stall the
+// stream. Returns false if the window was closed.
+func (w *SendWindow) Acquire(n int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.enabled && !w.suspended && w.credit <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return false
+	}
+	if w.enabled && !w.suspended {
+		w.credit -= n
+	}
+	return true
+}
+
+// Suspend stops enforcing credit, releasing anyone waiting in Acquire, while the stream's link is
+// down and what is sent is only buffered for resuming it.
+func (w *SendWindow) Suspend() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.suspended = true
+	w.cond.Broadcast()
+}
+
+// Reset forgets the credit granted so far when a stream is resumed, the peer grants a new window.
+// It ends a Suspend.
+func (w *SendWindow) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.suspended = false
+	w.credit = 0
+}
+
+// Close releases anyone waiting in Acquire.
+func (w *SendWindow) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// ReceiveWindow decides when to return credit to the peer as received bytes are consumed.
+type ReceiveWindow struct {
+	mu       sync.Mutex
+	size     int
+	consumed int
+}
+
+func NewReceiveWindow(size int) *ReceiveWindow {
+	if size <= 0 {
+		size = DefaultWindowSize
+	}
+	return &ReceiveWindow{size: size}
+}
+
+// Size is the initial credit to grant the peer.
+func (w *ReceiveWindow) Size() int {
+	return w.size
+}
+
+// Reset forgets the bytes consumed since the last grant when a stream is resumed and the peer is
+// granted a new window.
+func (w *ReceiveWindow) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.consumed = 0
+}
+
+// Consume records n bytes handed to the reader and returns the credit to grant the peer, or 0
+// if it isn't worth sending an update yet.
+func (w *ReceiveWindow) Consume(n int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.consumed += n
+	if w.consumed < w.size/2 {
+		return 0
+	}
+	grant := w.consumed
+	w.consumed = 0
+	return grant
+}
+
+// QueuedMessage is a message waiting for a stream's reader with the credit to return to the peer
+// once it is delivered. Bodies reassembled from fragments were mostly credited as the fragments
+// arrived.
+type QueuedMessage struct {
+	Message Message
+	Credit  int
+}
+
+// DeliveryQueue buffers the messages of one stream between the loop reading the link and the
+// stream's reader, so that a slow reader only holds up its own stream.
+type DeliveryQueue struct {
+	mu      sync.Mutex
+	queue   []QueuedMessage
+	bytes   int
+	notify  chan struct{}
+	drained chan struct{}
+}
+
+func NewDeliveryQueue() *DeliveryQueue {
+	return &DeliveryQueue{
+		notify:  make(chan struct{}, 1),
+		drained: make(chan struct{}, 1),
+	}
+}
+
+// Push queues a message. Unless unbounded, which it is for peers that do flow control, it waits
+// while LegacyQueueLength messages are queued. It gives up on the message if done is closed
+// meanwhile, and returns ErrDeliveryTimeout if timeout fires first. A nil timeout waits forever.
+func (q *DeliveryQueue) Push(message Message, credit int, unbounded bool, done <-chan struct{}, timeout <-chan time.Time) error {
+	for {
+		q.mu.Lock()
+		if unbounded || len(q.queue) < LegacyQueueLength {
+			q.queue = append(q.queue, QueuedMessage{Message: message, Credit: credit})
+			q.bytes += credit
+			q.mu.Unlock()
+			Signal(q.notify)
+			return nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.drained:
+		case <-done:
+			return nil
+		case <-timeout:
+			return ErrDeliveryTimeout
+		}
+	}
+}
+
+// Bytes returns the credit of the queued messages.
+func (q *DeliveryQueue) Bytes() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+// Next waits for the next message. It returns false once done is closed and the queue is empty.
+func (q *DeliveryQueue) Next(done <-chan struct{}) (QueuedMessage, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.queue) > 0 {
+			queued := q.queue[0]
+			q.queue = q.queue[1:]
+			q.bytes -= queued.Credit
+			q.mu.Unlock()
+			return queued, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-done:
+			return QueuedMessage{}, false
+		}
+	}
+}
+
+// Delivered tells a Push waiting for room that the reader took a message.
+func (q *DeliveryQueue) Delivered() {
+	Signal(q.drained)
+}
+
+// Signal wakes whoever waits on c, a channel with a buffer of one, without blocking if it has
+// already been woken.
+func Signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveryQueueBounded(t *testing.T) {
+	queue := NewDeliveryQueue()
+	done := make(chan struct{})
+	for i := 0; i < LegacyQueueLength; i++ {
+		if err := queue.Push(Message{Key: "key", Type: Body, Body: "a"}, 1, false, done, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := queue.Push(Message{Key: "key", Type: Body, Body: "b"}, 1, false, done, time.After(10*time.Millisecond)); err != ErrDeliveryTimeout {
+		t.Fatalf("Expected a full queue to time out, got %v", err)
+	}
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- queue.Push(Message{Key: "key", Type: Body, Body: "d"}, 1, false, done, nil)
+	}()
+	if queued, ok := queue.Next(done); !ok || queued.Message.Body != "a" || queued.Credit != 1 {
+		t.Fatalf("Expected the first message, got %+v", queued)
+	}
+	queue.Delivered()
+	if err := <-pushed; err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Push(Message{Key: "key", Type: Body, Body: "c"}, 1, true, done, nil); err != nil {
+		t.Fatalf("Expected an unbounded push not to wait, got %v", err)
+	}
+	if queue.Bytes() != LegacyQueueLength+1 {
+		t.Fatalf("Expected %v bytes queued, got %v", LegacyQueueLength+1, queue.Bytes())
+	}
+
+	close(done)
+	for i := 0; i < LegacyQueueLength+1; i++ {
+		if _, ok := queue.Next(done); !ok {
+			t.Fatalf("Expected message %v to still be delivered", i)
+		}
+	}
+	if _, ok := queue.Next(done); ok {
+		t.Fatal("Expected the closed queue to be empty")
+	}
+}
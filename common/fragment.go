@@ -0,0 +1,112 @@
+package common
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// DefaultMaxFrameSize is the largest body a side accepts in one message unless configured
+	// otherwise. Larger bodies are split into Fragment messages.
+	DefaultMaxFrameSize = 64 * 1024
+	// DefaultMaxMessageSize bounds the size of a body reassembled from fragments.
+	DefaultMaxMessageSize = 32 * 1024 * 1024
+	// frameOverhead is allowed on top of the max frame size for the message key and header when
+	// limiting reads from the websocket.
+	frameOverhead = 1024
+)
+
+// A body larger than the peer's max frame size is sent as Fragment messages carrying consecutive
+// pieces of it, followed by a Body message carrying the last piece. Fragments are only sent to a
+// peer whose hello lists the Fragment type and only on binary framed links, where each piece keeps
+// its raw bytes.
+
+// ReadLimit is the websocket read limit that lets through every frame of at most maxFrameSize.
+func ReadLimit(maxFrameSize int) int64 {
+	return int64(maxFrameSize + frameOverhead)
+}
+
+// Fragmenter splits bodies for a peer. The zero value doesn't split, which is right for peers that
+// haven't said they reassemble fragments. It is safe for concurrent use.
+type Fragmenter struct {
+	size int64
+}
+
+// SetSize sets the largest body to send in one message. Zero disables splitting.
+func (f *Fragmenter) SetSize(size int) {
+	atomic.StoreInt64(&f.size, int64(size))
+}
+
+// Split returns the messages to send for message, in order.
+func (f *Fragmenter) Split(message Message) []Message {
+	size := int(atomic.LoadInt64(&f.size))
+	if message.Type != Body || size <= 0 || len(message.Body) <= size {
+		return []Message{message}
+	}
+
+	var messages []Message
+	body := message.Body
+	for len(body) > size {
+		messages = append(messages, Message{Key: message.Key, Type: Fragment, Body: body[:size], Binary: message.Binary})
+		body = body[size:]
+	}
+	return append(messages, Message{Key: message.Key, Type: Body, Body: body, Binary: message.Binary})
+}
+
+// Reassembler puts fragmented bodies back together. It is not safe for concurrent use, it belongs
+// to the goroutine reading a link.
+type Reassembler struct {
+	maxFrameSize   int
+	maxMessageSize int
+	partial        map[string][]byte
+}
+
+// NewReassembler returns a Reassembler that rejects bodies larger than maxMessageSize. Zero
+// disables the check.
+func NewReassembler(maxMessageSize int) *Reassembler {
+	return &Reassembler{
+		maxMessageSize: maxMessageSize,
+		partial:        make(map[string][]byte),
+	}
+}
+
+// LimitFrames starts rejecting frames larger than maxFrameSize. It is called once the peer has
+// been told the limit in the hello exchange; peers that predate it may send frames of any size.
+func (r *Reassembler) LimitFrames(maxFrameSize int) {
+	r.maxFrameSize = maxFrameSize
+}
+
+// Add takes a Body or Fragment message read from the link. It returns the complete message and
+// true once a body is complete, or false while more fragments are expected. An error means the
+// peer broke the limits and the stream should be closed with CloseProtocolError.
+func (r *Reassembler) Add(message Message) (Message, bool, error) {
+	if r.maxFrameSize > 0 && len(message.Body) > r.maxFrameSize {
+		r.Forget(message.Key)
+		return message, false, fmt.Errorf("Frame of %v bytes for key %v exceeds the max frame size of %v", len(message.Body), message.Key, r.maxFrameSize)
+	}
+
+	partial, ok := r.partial[message.Key]
+	if !ok && message.Type == Body {
+		return message, true, nil
+	}
+
+	if r.maxMessageSize > 0 && len(partial)+len(message.Body) > r.maxMessageSize {
+		r.Forget(message.Key)
+		return message, false, fmt.Errorf("Fragmented message for key %v exceeds the max message size of %v", message.Key, r.maxMessageSize)
+	}
+	partial = append(partial, message.Body...)
+
+	if message.Type == Fragment {
+		r.partial[message.Key] = partial
+		return message, false, nil
+	}
+
+	delete(r.partial, message.Key)
+	message.Body = string(partial)
+	return message, true, nil
+}
+
+// Forget drops any partial body for a stream that has closed.
+func (r *Reassembler) Forget(msgKey string) {
+	delete(r.partial, msgKey)
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestFragmentRoundTrip(t *testing.T) {
+	fragmenter := &Fragmenter{}
+	message := Message{Key: "key", Type: Body, Body: "0123456789", Binary: true}
+	if parts := fragmenter.Split(message); len(parts) != 1 {
+		t.Fatalf("The zero Fragmenter shouldn't split: %v", parts)
+	}
+
+	fragmenter.SetSize(4)
+	parts := fragmenter.Split(message)
+	if len(parts) != 3 || parts[0].Type != Fragment || parts[1].Type != Fragment || parts[2].Type != Body || !parts[1].Binary {
+		t.Fatalf("Unexpected fragments: %#v", parts)
+	}
+
+	reassembler := NewReassembler(0)
+	reassembler.LimitFrames(4)
+	for i, part := range parts {
+		result, complete, err := reassembler.Add(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if complete != (i == len(parts)-1) {
+			t.Fatalf("Unexpected completion at fragment %v", i)
+		}
+		if complete && result != message {
+			t.Fatalf("Reassembled %#v, expected %#v", result, message)
+		}
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	reassembler := NewReassembler(6)
+	if _, complete, err := reassembler.Add(Message{Key: "key", Type: Body, Body: "0123456789"}); err != nil || !complete {
+		t.Fatal("Frames should be unlimited until the peer is told the limit")
+	}
+
+	reassembler.LimitFrames(4)
+	if _, _, err := reassembler.Add(Message{Key: "key", Type: Body, Body: "01234"}); err == nil {
+		t.Fatal("Expected an error for a frame over the limit")
+	}
+
+	reassembler.Add(Message{Key: "key", Type: Fragment, Body: "0123"})
+	if _, _, err := reassembler.Add(Message{Key: "key", Type: Fragment, Body: "0123"}); err == nil {
+		t.Fatal("Expected an error for a message over the limit")
+	}
+	if _, complete, err := reassembler.Add(Message{Key: "key", Type: Body, Body: "01"}); err != nil || !complete {
+		t.Fatal("Expected the failed message to have been forgotten")
+	}
+}
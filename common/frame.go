@@ -0,0 +1,142 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+)
+
+// BinaryProtocol is the websocket subprotocol a backend requests to frame messages in the
+// binary format below instead of the legacy "key||type||body" text format. Backends that
+// don't request it (and proxies that don't offer it) keep using text frames.
+const BinaryProtocol = "rancher-binary.v1"
+
+// Binary frame layout:
+//
+//	version (1 byte) | type (1 byte) | flags (1 byte) | key | body
+//
+// The key is either 16 raw bytes (flagUUIDKey) or a uvarint length followed by the key bytes.
+// The body is the remainder of the frame and is never encoded.
+const (
+	frameVersion    byte = 1
+	frameHeaderSize      = 3
+)
+
+const (
+	flagBinary  byte = 1 << iota // body holds raw bytes rather than text
+	flagUUIDKey                  // key is a UUID packed into 16 bytes
+)
+
+// EncodeMessage serializes a message for a link using the given protocol and returns the
+// websocket message type to send it with.
+func EncodeMessage(protocol string, message Message) (int, []byte, error) {
+	if protocol == BinaryProtocol {
+		data, err := EncodeFrame(message)
+		return websocket.BinaryMessage, data, err
+	}
+
+	body := message.Body
+	if message.Binary {
+		body = base64.StdEncoding.EncodeToString([]byte(body))
+	}
+	return websocket.TextMessage, []byte(FormatMessage(message.Key, message.Type, body)), nil
+}
+
+// DecodeMessage parses a message read from a link using the given protocol. Any error means the
+// peer broke the protocol.
+func DecodeMessage(protocol string, msgType int, data []byte) (Message, error) {
+	if protocol == BinaryProtocol {
+		if msgType != websocket.BinaryMessage {
+			return Message{}, fmt.Errorf("Expected binary frame, received websocket message type %v", msgType)
+		}
+		message, err := DecodeFrame(data)
+		if err != nil {
+			return Message{}, err
+		}
+		return message, ValidateMessage(message)
+	}
+
+	if msgType != websocket.TextMessage {
+		return Message{}, fmt.Errorf("Expected text frame, received websocket message type %v", msgType)
+	}
+	return ParseMessage(string(data))
+}
+
+// EncodeFrame serializes a message into a binary frame.
+func EncodeFrame(message Message) ([]byte, error) {
+	if len(message.Type) != 1 {
+		return nil, fmt.Errorf("Message type %q can't be represented in a binary frame", message.Type)
+	}
+
+	var flags byte
+	if message.Binary {
+		flags |= flagBinary
+	}
+
+	packedKey := packKey(message.Key)
+	if packedKey != nil {
+		flags |= flagUUIDKey
+	}
+
+	data := make([]byte, frameHeaderSize, frameHeaderSize+binary.MaxVarintLen64+len(message.Key)+len(message.Body))
+	data[0] = frameVersion
+	data[1] = message.Type[0]
+	data[2] = flags
+
+	if packedKey != nil {
+		data = append(data, packedKey...)
+	} else {
+		var length [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(length[:], uint64(len(message.Key)))
+		data = append(data, length[:n]...)
+		data = append(data, message.Key...)
+	}
+
+	return append(data, message.Body...), nil
+}
+
+// DecodeFrame parses a binary frame produced by EncodeFrame.
+func DecodeFrame(data []byte) (Message, error) {
+	if len(data) < frameHeaderSize {
+		return Message{}, fmt.Errorf("Frame too short: %v bytes", len(data))
+	}
+	if data[0] != frameVersion {
+		return Message{}, fmt.Errorf("Unsupported frame version %v", data[0])
+	}
+
+	message := Message{
+		Type:   MessageType(data[1:2]),
+		Binary: data[2]&flagBinary != 0,
+	}
+	rest := data[frameHeaderSize:]
+
+	if data[2]&flagUUIDKey != 0 {
+		if len(rest) < 16 {
+			return Message{}, fmt.Errorf("Frame too short for packed key: %v bytes", len(data))
+		}
+		message.Key = uuid.UUID(rest[:16]).String()
+		rest = rest[16:]
+	} else {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < length {
+			return Message{}, fmt.Errorf("Invalid key length in frame")
+		}
+		message.Key = string(rest[n : n+int(length)])
+		rest = rest[n+int(length):]
+	}
+
+	message.Body = string(rest)
+	return message, nil
+}
+
+// packKey returns the 16 byte form of key if it is a canonical UUID, otherwise nil.
+func packKey(key string) []byte {
+	parsed := uuid.Parse(key)
+	if parsed == nil || parsed.String() != key {
+		return nil
+	}
+	return parsed
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	messages := []Message{
+		{Key: uuid.New(), Type: Body, Body: "hello"},
+		{Key: "not-a-uuid", Type: Connect, Body: "/v1/logs/?token=abc"},
+		{Key: uuid.New(), Type: Body, Body: string([]byte{0, 1, 2, 255}), Binary: true},
+		{Key: "", Type: Close},
+	}
+
+	for _, expected := range messages {
+		data, err := EncodeFrame(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := DecodeFrame(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Fatalf("Expected %#v, got %#v", expected, actual)
+		}
+	}
+}
+
+func TestFramePacksUUIDKeys(t *testing.T) {
+	key := uuid.New()
+	data, err := EncodeFrame(Message{Key: key, Type: Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != frameHeaderSize+16 {
+		t.Fatalf("Expected packed key, frame was %v bytes", len(data))
+	}
+}
+
+func TestTextProtocolEncodesBinaryBodies(t *testing.T) {
+	_, data, err := EncodeMessage("", Message{Key: "1", Type: Body, Body: "\x00\x01", Binary: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1||1||AAE=" {
+		t.Fatalf("Unexpected text frame: %s", data)
+	}
+}
+
+func TestDecodeFrameRejectsTruncatedFrames(t *testing.T) {
+	for _, data := range [][]byte{nil, {frameVersion, '1'}, {2, '1', 0, 0}, {frameVersion, '1', flagUUIDKey, 1, 2}, {frameVersion, '1', 0, 5, 'a'}} {
+		if _, err := DecodeFrame(data); err == nil {
+			t.Fatalf("Expected error decoding %v", data)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the backend link protocol implemented by this package.
+const ProtocolVersion = 1
+
+// Handshake is the body of a Hello message. A backend sends one with an empty key as soon as it
+// connects, describing itself. The proxy replies with one describing what it enabled for the
+// link: the message types both sides support and the largest frame body it accepts. Proxies that
+// predate the handshake never reply, so neither side may depend on the reply arriving.
+// MaxFrameSize is always the limit of the side sending the handshake.
+type Handshake struct {
+	Version      int               `json:"version"`
+	AgentVersion string            `json:"agentVersion,omitempty"`
+	MessageTypes []MessageType     `json:"messageTypes,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	MaxFrameSize int               `json:"maxFrameSize,omitempty"`
+}
+
+// Supports reports whether the peer that sent the handshake understands the message type.
+func (h *Handshake) Supports(messageType MessageType) bool {
+	if h == nil {
+		return false
+	}
+	for _, t := range h.MessageTypes {
+		if t == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+func NewHello(handshake Handshake) (Message, error) {
+	data, err := json.Marshal(handshake)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: Hello, Body: string(data)}, nil
+}
+
+func ParseHello(message Message) (Handshake, error) {
+	var handshake Handshake
+	if err := json.Unmarshal([]byte(message.Body), &handshake); err != nil {
+		return handshake, fmt.Errorf("Invalid hello: %v", err)
+	}
+	return handshake, nil
+}
+
+// CommonMessageTypes returns the message types supported by both this package and the peer.
+func CommonMessageTypes(peer Handshake) []MessageType {
+	var result []MessageType
+	for _, t := range SupportedMessageTypes() {
+		if peer.Supports(t) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// WithoutMessageType returns types without t, for a side that supports a message type only when it
+// is configured to.
+func WithoutMessageType(types []MessageType, t MessageType) []MessageType {
+	var result []MessageType
+	for _, messageType := range types {
+		if messageType != t {
+			result = append(result, messageType)
+		}
+	}
+	return result
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// DefaultReplayBufferSize bounds the bytes of bodies kept per stream for resuming it. It covers a
+// full flow control window in flight plus as much again written while the link is down.
+const DefaultReplayBufferSize = 2 * DefaultWindowSize
+
+// A stream whose link is lost can be resumed on a new link by a backend that reconnects with the
+// same identity. Both sides count the Body, WriteDone and Close messages they receive on each
+// stream, counting a fragmented body once it is complete, and keep the ones they sent in a
+// ReplayBuffer. The backend sends a Resume carrying its count for every stream it kept, the
+// proxy answers with its own count, or with a Close if it gave up on the stream, and each side
+// then sends again what the other is missing. Flow control starts over: each side forgets the
+// credit it had and grants the other a new window after the Resume.
+
+// NewResume builds the message resuming msgKey on a new link. received is the number of sequenced
+// messages the sender has received on the stream.
+func NewResume(msgKey string, received uint64) Message {
+	return Message{
+		Key:  msgKey,
+		Type: Resume,
+		Body: strconv.FormatUint(received, 10),
+	}
+}
+
+// ParseResume returns the number of sequenced messages the peer has received.
+func ParseResume(message Message) (uint64, error) {
+	n, err := strconv.ParseUint(message.Body, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid resume %q", message.Body)
+	}
+	return n, nil
+}
+
+// Sequenced reports whether messages of a type are counted and replayed when a stream is resumed.
+func Sequenced(messageType MessageType) bool {
+	return messageType == Body || messageType == WriteDone || messageType == Close
+}
+
+// ReplayBuffer keeps the last sequenced messages sent on a stream, up to a number of body bytes,
+// so that those lost with a link can be sent again. It is safe for concurrent use.
+type ReplayBuffer struct {
+	mu       sync.Mutex
+	size     int
+	bytes    int
+	sent     uint64
+	messages []Message
+}
+
+func NewReplayBuffer(size int) *ReplayBuffer {
+	if size <= 0 {
+		size = DefaultReplayBufferSize
+	}
+	return &ReplayBuffer{size: size}
+}
+
+// Add records a sequenced message as sent, dropping the oldest ones once the buffer is over its
+// size. The newest message is always kept.
+func (b *ReplayBuffer) Add(message Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent++
+	b.messages = append(b.messages, message)
+	b.bytes += len(message.Body)
+	for b.bytes > b.size && len(b.messages) > 1 {
+		b.bytes -= len(b.messages[0].Body)
+		b.messages = b.messages[1:]
+	}
+}
+
+// Since returns the messages the peer is missing given how many it received. It fails if some of
+// them were already dropped, in which case the stream can't be resumed.
+func (b *ReplayBuffer) Since(received uint64) ([]Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if received > b.sent {
+		return nil, fmt.Errorf("Peer received %v messages but only %v were sent", received, b.sent)
+	}
+	missing := b.sent - received
+	if missing > uint64(len(b.messages)) {
+		return nil, fmt.Errorf("%v messages to replay but only %v were kept", missing, len(b.messages))
+	}
+	return append([]Message(nil), b.messages[uint64(len(b.messages))-missing:]...), nil
+}
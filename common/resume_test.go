@@ -0,0 +1,65 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestReplayBufferSince(t *testing.T) {
+	buffer := NewReplayBuffer(10)
+	for _, body := range []string{"aaaa", "bbbb", "cccc"} {
+		buffer.Add(Message{Key: "key", Type: Body, Body: body})
+	}
+
+	// The first body was dropped to stay within 10 bytes
+	messages, err := buffer.Since(1)
+	if err != nil || len(messages) != 2 || messages[0].Body != "bbbb" || messages[1].Body != "cccc" {
+		t.Fatalf("Expected the last two bodies, got %v %v", messages, err)
+	}
+	if messages, err := buffer.Since(3); err != nil || len(messages) != 0 {
+		t.Fatalf("Expected nothing to replay, got %v %v", messages, err)
+	}
+	if _, err := buffer.Since(0); err == nil {
+		t.Fatal("Expected an error replaying a dropped body")
+	}
+	if _, err := buffer.Since(4); err == nil {
+		t.Fatal("Expected an error for a peer ahead of what was sent")
+	}
+}
+
+func TestReplayBufferKeepsNewest(t *testing.T) {
+	buffer := NewReplayBuffer(2)
+	buffer.Add(Message{Key: "key", Type: Body, Body: "too large"})
+	if messages, err := buffer.Since(0); err != nil || len(messages) != 1 {
+		t.Fatalf("Expected the newest body to be kept, got %v %v", messages, err)
+	}
+}
+
+func TestResumeRoundTrip(t *testing.T) {
+	if n, err := ParseResume(NewResume("key", 42)); err != nil || n != 42 {
+		t.Fatalf("Expected 42, got %v %v", n, err)
+	}
+	if _, err := ParseResume(Message{Key: "key", Type: Resume, Body: "-1"}); err == nil {
+		t.Fatal("Expected an error for a negative count")
+	}
+}
+
+func TestSendWindowSuspend(t *testing.T) {
+	window := NewSendWindow()
+	window.Grant(1)
+	window.Acquire(1)
+	window.Suspend()
+	if !window.Acquire(100) {
+		t.Fatal("Expected a suspended window not to block")
+	}
+	window.Reset()
+	window.Grant(5)
+	window.Acquire(5)
+	acquired := make(chan bool)
+	go func() {
+		acquired <- window.Acquire(1)
+	}()
+	window.Close()
+	if <-acquired {
+		t.Fatal("Expected a reset window to enforce credit again")
+	}
+}
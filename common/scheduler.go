@@ -0,0 +1,228 @@
+package common
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Priority is the scheduling class of a stream on a backend link.
+type Priority int
+
+const (
+	// PriorityBulk is for high volume streams nobody is waiting on keystroke by keystroke, like
+	// logs and stats.
+	PriorityBulk Priority = iota
+	// PriorityNormal is for everything else.
+	PriorityNormal
+	// PriorityInteractive is for exec and console sessions.
+	PriorityInteractive
+)
+
+// weights are the relative share of the link each class gets while streams of several classes
+// have messages waiting.
+var weights = map[Priority]int{
+	PriorityBulk:        1,
+	PriorityNormal:      4,
+	PriorityInteractive: 16,
+}
+
+const (
+	// quantum is the number of body bytes a stream with weight 1 may send per scheduling round.
+	quantum = 8 * 1024
+	// maxQueuedPerKey bounds the messages waiting for one stream. Push blocks while it is full.
+	maxQueuedPerKey = 16
+)
+
+// PathPriority classifies a frontend path: exec and console are interactive, logs and stats are
+// bulk.
+func PathPriority(path string) Priority {
+	parts := strings.Split(strings.Trim(strings.ToLower(path), "/"), "/")
+	if len(parts) > 1 && parts[0] == "v1" {
+		parts = parts[1:]
+	}
+	switch parts[0] {
+	case "exec", "console":
+		return PriorityInteractive
+	case "logs", "stats", "hoststats", "containerstats":
+		return PriorityBulk
+	}
+	return PriorityNormal
+}
+
+// URLPriority is PathPriority for the URL carried by a Connect message.
+func URLPriority(rawURL string) Priority {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return PriorityNormal
+	}
+	return PathPriority(u.Path)
+}
+
+// Scheduler replaces a FIFO channel of messages to write to a link. It keeps a queue per message
+// key and serves the keys with deficit round robin weighted by their priority, so a busy bulk
+// stream can't hold up an interactive one. Messages for a key keep their order. Hello, GoingAway,
+// WindowUpdate and Resume messages don't depend on the order of bodies and skip the queues.
+type Scheduler struct {
+	mu      sync.Mutex
+	space   *sync.Cond
+	urgent  []Message
+	streams map[string]*scheduledStream
+	active  []*scheduledStream
+	ready   chan struct{}
+	closed  bool
+}
+
+type scheduledStream struct {
+	key      string
+	priority Priority
+	queue    []Message
+	deficit  int
+	active   bool
+	closing  bool
+}
+
+func NewScheduler() *Scheduler {
+	s := &Scheduler{
+		streams: make(map[string]*scheduledStream),
+		ready:   make(chan struct{}, 1),
+	}
+	s.space = sync.NewCond(&s.mu)
+	return s
+}
+
+// SetPriority sets the class of a stream. Connect messages pushed to the scheduler set it from
+// their URL.
+func (s *Scheduler) SetPriority(key string, priority Priority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stream(key).priority = priority
+}
+
+// Priority returns the class of a stream.
+func (s *Scheduler) Priority(key string) Priority {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stream, ok := s.streams[key]; ok {
+		return stream.priority
+	}
+	return PriorityNormal
+}
+
+func (s *Scheduler) stream(key string) *scheduledStream {
+	stream, ok := s.streams[key]
+	if !ok {
+		stream = &scheduledStream{key: key, priority: PriorityNormal}
+		s.streams[key] = stream
+	}
+	return stream
+}
+
+// Push queues a message, waiting while its stream has too many messages queued. It returns false
+// if the scheduler was closed.
+func (s *Scheduler) Push(message Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+
+	if message.Type == Hello || message.Type == GoingAway || message.Type == WindowUpdate || message.Type == Resume {
+		s.urgent = append(s.urgent, message)
+		Signal(s.ready)
+		return true
+	}
+
+	stream := s.stream(message.Key)
+	for len(stream.queue) >= maxQueuedPerKey && !s.closed {
+		s.space.Wait()
+	}
+	if s.closed {
+		return false
+	}
+
+	if message.Type == Connect {
+		stream.priority = URLPriority(message.Body)
+	}
+	stream.queue = append(stream.queue, message)
+	if message.Type == Close {
+		stream.closing = true
+	}
+	if !stream.active {
+		stream.active = true
+		s.active = append(s.active, stream)
+	}
+	Signal(s.ready)
+	return true
+}
+
+// Forget drops the state of a stream that has closed without a Close being pushed for it, like
+// one closed by the peer. Messages already queued for it are still sent.
+func (s *Scheduler) Forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stream, ok := s.streams[key]
+	if !ok {
+		return
+	}
+	if stream.active {
+		stream.closing = true
+		return
+	}
+	delete(s.streams, key)
+}
+
+// Ready is signaled when messages have been pushed. Whoever writes to the link waits on it when
+// Next returns nothing.
+func (s *Scheduler) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Next returns the next message to write to the link, or false if there is none.
+func (s *Scheduler) Next() (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.urgent) > 0 {
+		message := s.urgent[0]
+		s.urgent = s.urgent[1:]
+		return message, true
+	}
+
+	for len(s.active) > 0 {
+		stream := s.active[0]
+		message := stream.queue[0]
+		cost := len(message.Body)
+		if cost > stream.deficit {
+			// Out of credit for this round, move to the back with its next quantum
+			stream.deficit += quantum * weights[stream.priority]
+			s.active = append(s.active[1:], stream)
+			continue
+		}
+
+		stream.deficit -= cost
+		stream.queue = stream.queue[1:]
+		s.space.Broadcast()
+		if len(stream.queue) == 0 {
+			stream.active = false
+			stream.deficit = 0
+			s.active = s.active[1:]
+			if stream.closing {
+				delete(s.streams, stream.key)
+			}
+		}
+		return message, true
+	}
+	return Message{}, false
+}
+
+// Close drops everything queued and unblocks Push. It is called when the link goes away.
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.urgent = nil
+	s.active = nil
+	s.streams = make(map[string]*scheduledStream)
+	s.space.Broadcast()
+}
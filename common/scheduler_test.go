@@ -0,0 +1,113 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathPriority(t *testing.T) {
+	cases := map[string]Priority{
+		"/v1/exec/":                   PriorityInteractive,
+		"/v1/console":                 PriorityInteractive,
+		"/v1/logs/":                   PriorityBulk,
+		"/v1/hostStats/project":       PriorityBulk,
+		"/v1/container-proxy/foo/bar": PriorityNormal,
+		"/":                           PriorityNormal,
+	}
+	for path, expected := range cases {
+		if p := PathPriority(path); p != expected {
+			t.Errorf("Expected %v for %v, got %v", expected, path, p)
+		}
+	}
+}
+
+func TestSchedulerFavorsInteractive(t *testing.T) {
+	s := NewScheduler()
+	s.Push(Message{Key: "logs", Type: Connect, Body: "ws://host/v1/logs/"})
+	s.Push(Message{Key: "exec", Type: Connect, Body: "ws://host/v1/exec/"})
+	next(t, s)
+	next(t, s)
+
+	chunk := strings.Repeat("x", 8*1024)
+	for i := 0; i < 10; i++ {
+		s.Push(Message{Key: "logs", Type: Body, Body: chunk})
+	}
+	s.Push(Message{Key: "exec", Type: Body, Body: "ls\n"})
+
+	for i := 0; i < 3; i++ {
+		if m := next(t, s); m.Key == "exec" {
+			return
+		}
+	}
+	t.Fatal("Interactive stream waited behind the bulk stream's backlog")
+}
+
+func TestSchedulerKeepsOrderAndSkipsControl(t *testing.T) {
+	s := NewScheduler()
+	s.Push(Message{Key: "a", Type: Body, Body: "1"})
+	s.Push(Message{Key: "a", Type: Body, Body: "2"})
+	s.Push(Message{Key: "a", Type: Close})
+	s.Push(NewWindowUpdate("b", 10))
+
+	if m := next(t, s); m.Type != WindowUpdate {
+		t.Fatalf("Expected the window update first, got %#v", m)
+	}
+	for _, expected := range []string{"1", "2", ""} {
+		if m := next(t, s); m.Body != expected {
+			t.Fatalf("Expected body %q, got %#v", expected, m)
+		}
+	}
+	if _, ok := s.Next(); ok {
+		t.Fatal("Expected the scheduler to be empty")
+	}
+}
+
+func TestSchedulerForgetsStreamClosedByPeer(t *testing.T) {
+	s := NewScheduler()
+	s.SetPriority("idle", PriorityInteractive)
+	s.Push(Message{Key: "busy", Type: Body, Body: "1"})
+
+	// The peer closed both streams, nothing pushed a Close for them
+	s.Forget("idle")
+	s.Forget("busy")
+	if _, ok := s.streams["idle"]; ok {
+		t.Fatal("Expected the idle stream to be forgotten")
+	}
+	if m := next(t, s); m.Body != "1" {
+		t.Fatalf("Expected the queued body to still be sent, got %#v", m)
+	}
+	if len(s.streams) != 0 {
+		t.Fatalf("Expected no streams left, got %v", len(s.streams))
+	}
+}
+
+func TestSchedulerCloseUnblocksPush(t *testing.T) {
+	s := NewScheduler()
+	for i := 0; i < maxQueuedPerKey; i++ {
+		s.Push(Message{Key: "a", Type: Body, Body: "x"})
+	}
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- s.Push(Message{Key: "a", Type: Body, Body: "x"})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Expected push to wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Close()
+	if <-pushed {
+		t.Fatal("Expected push to fail after close")
+	}
+}
+
+func next(t *testing.T, s *Scheduler) Message {
+	m, ok := s.Next()
+	if !ok {
+		t.Fatal("Expected a message")
+	}
+	return m
+}
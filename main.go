@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/rancher/websocket-proxy/proxy"
@@ -33,6 +38,9 @@ func main() {
 			"/r/projects/{project}/{service}{path:.*}",
 			"/r/{service}{path:.*}",
 		},
+		PortForwardPaths: []string{
+			"/v1/portforward",
+		},
 		StatsPaths: []string{
 			"/v1/{hoststats:hoststats(\\/project)?(\\/)?}",
 			"/v1/{containerstats:containerstats(\\/service)?(\\/)?}",
@@ -57,7 +65,25 @@ func main() {
 	log.Infof("Starting websocket proxy. Listening on [%s], Proxying to cattle API at [%s], Monitoring parent pid [%v].",
 		conf.ListenAddr, conf.CattleAddr, conf.ParentPid)
 
+	go drainOnSignal(p, conf)
 	err = p.StartProxy()
 
 	log.WithFields(log.Fields{"error": err}).Info("Exiting proxy.")
 }
+
+// drainOnSignal drains the proxy when it is asked to stop, giving open streams the drain grace
+// period to finish before exiting.
+func drainOnSignal(p *proxy.Starter, conf *proxy.Config) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Infof("Received %v, draining backends for up to %v.", sig, conf.DrainGracePeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.DrainGracePeriod)
+	defer cancel()
+	if err := p.Drain(ctx); err != nil {
+		log.WithFields(log.Fields{"error": err}).Warn("Backends didn't all disconnect in time.")
+	}
+	log.Info("Exiting proxy.")
+	os.Exit(0)
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+const (
+	adminBackendsPath = "/v1/admin/backends"
+	adminMetricsPath  = "/metrics"
+	// adminCloseReason is what frontends and backends are told when an operator closes their stream
+	// or link.
+	adminCloseReason = "closed by an administrator"
+)
+
+// AdminHandler serves the admin API, for incident response. It lists the connected backends with
+// their links and streams, and lets an operator close a stream or disconnect a backend:
+//
+//	GET    /v1/admin/backends
+//	GET    /v1/admin/backends/{hostKey}
+//	DELETE /v1/admin/backends/{hostKey}
+//	DELETE /v1/admin/backends/{hostKey}/streams/{streamKey}
+//	GET    /v1/admin/events
+//	GET    /metrics
+//
+// The events endpoint streams backends connecting, being replaced and disconnecting, see
+// backendEvent, and the metrics endpoint serves the proxy's Prometheus metrics. Every request must carry the admin token as a bearer Authorization header.
+type AdminHandler struct {
+	backends *backendProxyManager
+	token    string
+	router   *mux.Router
+}
+
+// adminBackend describes a backend with its links, and the streams kept for it to resume if it
+// lost a link.
+type adminBackend struct {
+	HostKey string        `json:"hostKey"`
+	Links   []adminLink   `json:"links"`
+	Parked  []adminStream `json:"parked,omitempty"`
+}
+
+type adminLink struct {
+	SessionID      string            `json:"sessionId"`
+	Connected      time.Time         `json:"connected"`
+	Protocol       string            `json:"protocol,omitempty"`
+	AgentVersion   string            `json:"agentVersion,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	RTTMillis      float64           `json:"rttMillis"`
+	Draining       bool              `json:"draining"`
+	ProtocolErrors int               `json:"protocolErrors"`
+	Streams        []adminStream     `json:"streams"`
+}
+
+type adminStream struct {
+	Key      string    `json:"key"`
+	Path     string    `json:"path"`
+	Started  time.Time `json:"started"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+	Remote   string    `json:"remote,omitempty"`
+	Reverse  bool      `json:"reverse,omitempty"`
+}
+
+func newAdminHandler(backends *backendProxyManager, token string) *AdminHandler {
+	h := &AdminHandler{
+		backends: backends,
+		token:    token,
+		router:   mux.NewRouter(),
+	}
+	h.router.HandleFunc(adminBackendsPath, h.list).Methods("GET")
+	h.router.HandleFunc(adminBackendsPath+"/{hostKey}", h.show).Methods("GET")
+	h.router.HandleFunc(adminBackendsPath+"/{hostKey}", h.disconnect).Methods("DELETE")
+	h.router.HandleFunc(adminBackendsPath+"/{hostKey}/streams/{streamKey}", h.closeStream).Methods("DELETE")
+	h.router.HandleFunc(adminEventsPath, h.events).Methods("GET")
+	h.router.Handle(adminMetricsPath, promhttp.Handler()).Methods("GET")
+	return h
+}
+
+func (h *AdminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !h.authorized(req) {
+		authFailuresMetric.WithLabelValues(authAdminToken).Inc()
+		log.Warnf("Refusing unauthenticated admin request from %v: %v %v", req.RemoteAddr, req.Method, req.URL.Path)
+		http.Error(rw, "Failed authentication", 401)
+		return
+	}
+	h.router.ServeHTTP(rw, req)
+}
+
+func (h *AdminHandler) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if h.token == "" || len(auth) <= 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[7:])), []byte(h.token)) == 1
+}
+
+func (h *AdminHandler) list(rw http.ResponseWriter, req *http.Request) {
+	backends := []adminBackend{}
+	for _, hostKey := range h.backends.backendKeys() {
+		if backend, ok := h.backends.describe(hostKey); ok {
+			backends = append(backends, backend)
+		}
+	}
+	writeJSON(rw, map[string]interface{}{"backends": backends})
+}
+
+func (h *AdminHandler) show(rw http.ResponseWriter, req *http.Request) {
+	backend, ok := h.backends.describe(mux.Vars(req)["hostKey"])
+	if !ok {
+		http.Error(rw, "Backend not found", 404)
+		return
+	}
+	writeJSON(rw, backend)
+}
+
+func (h *AdminHandler) disconnect(rw http.ResponseWriter, req *http.Request) {
+	hostKey := mux.Vars(req)["hostKey"]
+	if !h.backends.disconnect(hostKey, adminCloseReason) {
+		http.Error(rw, "Backend not found", 404)
+		return
+	}
+	log.Infof("Admin request from %v disconnected backend %v.", req.RemoteAddr, hostKey)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) closeStream(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if !h.backends.closeStream(vars["hostKey"], vars["streamKey"], adminCloseReason) {
+		http.Error(rw, "Stream not found", 404)
+		return
+	}
+	log.Infof("Admin request from %v closed stream %v of backend %v.", req.RemoteAddr, vars["streamKey"], vars["hostKey"])
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Errorf("Failed to write admin response: %v", err)
+	}
+}
+
+// backendKeys returns the keys of the backends with links or parked streams, sorted.
+func (b *backendProxyManager) backendKeys() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var keys []string
+	for key := range b.multiplexers {
+		keys = append(keys, key)
+	}
+	for key := range b.parked {
+		if _, ok := b.multiplexers[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// describe returns what the admin API shows of a backend, or false if it has neither links nor
+// parked streams.
+func (b *backendProxyManager) describe(backendKey string) (adminBackend, bool) {
+	b.mu.RLock()
+	links := append([]*multiplexer(nil), b.multiplexers[backendKey]...)
+	var parked []*stream
+	for _, p := range b.parked[backendKey] {
+		parked = append(parked, p.stream)
+	}
+	b.mu.RUnlock()
+	if len(links) == 0 && len(parked) == 0 {
+		return adminBackend{}, false
+	}
+
+	backend := adminBackend{HostKey: backendKey, Links: []adminLink{}}
+	for _, m := range links {
+		backend.Links = append(backend.Links, m.describe())
+	}
+	for _, s := range parked {
+		backend.Parked = append(backend.Parked, s.describe())
+	}
+	sortStreams(backend.Parked)
+	return backend, true
+}
+
+// closeStream closes a stream on both sides, telling the frontend reason. It returns false if the
+// backend has no such stream.
+func (b *backendProxyManager) closeStream(backendKey, msgKey, reason string) bool {
+	s, err := b.stream(backendKey, msgKey)
+	if err != nil {
+		return false
+	}
+	closeMessage := common.NewClose(msgKey, common.CloseGoingAway, reason)
+	if m := s.link(); m != nil {
+		m.streamsMu.Lock()
+		delete(m.streams, msgKey)
+		m.streamsMu.Unlock()
+		m.scheduler.Push(closeMessage)
+	} else {
+		b.unpark(backendKey, msgKey)
+	}
+	s.closeWith(closeMessage)
+	return true
+}
+
+// disconnect closes every link of a backend and its streams, parked ones included. It returns false
+// if the backend has neither.
+func (b *backendProxyManager) disconnect(backendKey, reason string) bool {
+	b.mu.Lock()
+	links := append([]*multiplexer(nil), b.multiplexers[backendKey]...)
+	parked := b.parked[backendKey]
+	delete(b.parked, backendKey)
+	b.mu.Unlock()
+	if len(links) == 0 && len(parked) == 0 {
+		return false
+	}
+
+	for key, p := range parked {
+		p.timer.Stop()
+		p.stream.closeWith(common.NewClose(key, common.CloseGoingAway, reason))
+	}
+	for _, m := range links {
+		m.disconnect(reason)
+	}
+	return true
+}
+
+// disconnect closes the link right away. It is treated as drained, so its streams are closed with
+// reason rather than kept for the backend to resume.
+func (m *multiplexer) disconnect(reason string) {
+	m.drainOnce.Do(func() {
+		m.drainReason = reason
+		close(m.draining)
+	})
+	m.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(common.CloseGoingAway, reason),
+		time.Now().Add(time.Second))
+	m.ws.Close()
+}
+
+func (m *multiplexer) describe() adminLink {
+	link := adminLink{
+		SessionID:      m.backendSessionID,
+		Connected:      m.connected,
+		Protocol:       m.protocol,
+		RTTMillis:      float64(m.smoothedRTT()) / float64(time.Millisecond),
+		Draining:       m.isDraining(),
+		ProtocolErrors: m.errorCount(),
+		Streams:        []adminStream{},
+	}
+	m.helloMu.Lock()
+	if m.agent != nil {
+		link.AgentVersion = m.agent.AgentVersion
+		link.Labels = m.agent.Labels
+	}
+	m.helloMu.Unlock()
+
+	m.streamsMu.RLock()
+	for _, s := range m.streams {
+		link.Streams = append(link.Streams, s.describe())
+	}
+	m.streamsMu.RUnlock()
+	sortStreams(link.Streams)
+	return link
+}
+
+func (s *stream) describe() adminStream {
+	// Frontends may carry their token in the query, only the path is shown
+	path := s.getURL()
+	if u, err := url.Parse(path); err == nil {
+		path = u.Path
+	}
+	return adminStream{
+		Key:      s.key,
+		Path:     path,
+		Started:  s.started,
+		BytesIn:  atomic.LoadInt64(&s.bytesIn),
+		BytesOut: atomic.LoadInt64(&s.bytesOut),
+		Remote:   s.remote,
+		Reverse:  s.reverse,
+	}
+}
+
+func sortStreams(streams []adminStream) {
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].Started.Before(streams[j].Started)
+	})
+}
@@ -9,14 +9,31 @@ import (
 	"net/http/httputil"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/pborman/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rancher/websocket-proxy/proxy/apiinterceptor/filters"
 	"github.com/rancher/websocket-proxy/proxy/apiinterceptor/model"
 )
 
+var (
+	filterLatencyMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "websocket_proxy_api_filter_duration_seconds",
+		Help: "How long API interceptor filters took to process requests, by filter type.",
+	}, []string{"type"})
+	filterErrorsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_proxy_api_filter_errors_total",
+		Help: "Requests API interceptor filters failed or rejected, by filter type.",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(filterLatencyMetric, filterErrorsMetric)
+}
+
 type interceptor struct {
 	configFile         string
 	routerSetter       routerSetter
@@ -145,8 +162,11 @@ func (i *interceptor) processPreFilters(path string, otherPathsMatched []string,
 			continue
 		}
 
+		start := time.Now()
 		responseData, err := apiFilter.ProcessFilter(filterData, requestData)
+		filterLatencyMetric.WithLabelValues(filterData.Type).Observe(time.Since(start).Seconds())
 		if err != nil {
+			filterErrorsMetric.WithLabelValues(filterData.Type).Inc()
 			logrus.Errorf("Error %v processing the interceptor %v", err, filterData)
 			svcErr := model.ProxyError{
 				Status:  strconv.Itoa(http.StatusInternalServerError),
@@ -163,6 +183,7 @@ func (i *interceptor) processPreFilters(path string, otherPathsMatched []string,
 			}
 		} else {
 			//error
+			filterErrorsMetric.WithLabelValues(filterData.Type).Inc()
 			logrus.Errorf("Error response %v - %v while processing the interceptor %v for request path %v", responseData.Status, responseData.Message, filterData, api)
 			message := fmt.Sprintf("Error response while processing the interceptor endpoint %v", filterData.Endpoint)
 			if responseData.Message != "" {
@@ -5,26 +5,31 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
+
+	"github.com/rancher/websocket-proxy/common"
 )
 
 type BackendHandler struct {
 	proxyManager    proxyManager
 	parsedPublicKey interface{}
+	compression     *common.Compression
 }
 
 func (h *BackendHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	log.Infof("Handling backend connection request.")
 	hostKey, authed := h.auth(req)
 	if !authed {
+		authFailuresMetric.WithLabelValues(authBackendToken).Inc()
 		http.Error(rw, "Failed authentication", 401)
 		return
 	}
 
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{common.BinaryProtocol},
 	}
 
-	ws, err := upgrader.Upgrade(rw, req, nil)
+	ws, err := upgrade(upgrader, h.compression, rw, req, nil)
 	if err != nil {
 		log.Errorf("Error during upgrade for host [%v]: [%v]", hostKey, err)
 		http.Error(rw, "Failed to upgrade connection.", 500)
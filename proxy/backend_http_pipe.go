@@ -6,8 +6,9 @@ import (
 	"github.com/Sirupsen/logrus"
 )
 
-func NewHTTPPipe(rw http.ResponseWriter, backend backendProxy, hostKey string) (*BackendHTTPReader, *BackendHTTPWriter, error) {
-	msgKey, respChannel, err := backend.initializeClient(hostKey)
+// NewHTTPPipe opens a stream to hostKey's backend for an HTTP request from remote.
+func NewHTTPPipe(rw http.ResponseWriter, backend backendProxy, hostKey, remote string) (*BackendHTTPReader, *BackendHTTPWriter, error) {
+	msgKey, respChannel, err := backend.initializeClient(hostKey, remote)
 	if err != nil {
 		return nil, nil, err
 	}
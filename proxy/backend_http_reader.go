@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/websocket-proxy/common"
@@ -16,6 +17,10 @@ type BackendHTTPReader struct {
 	data            chan string
 	buffer          []byte
 	rw              http.ResponseWriter
+	wroteHeader     bool
+	hijacked        bool
+	closeReason     common.CloseReason
+	opened          time.Time
 }
 
 func NewBackendHTTPReader(rw http.ResponseWriter, hostKey, msgKey string, backend backendProxy, messages <-chan common.Message) *BackendHTTPReader {
@@ -26,6 +31,7 @@ func NewBackendHTTPReader(rw http.ResponseWriter, hostKey, msgKey string, backen
 		data:     make(chan string),
 		backend:  backend,
 		rw:       rw,
+		opened:   time.Now(),
 	}
 	go b.start()
 	return b
@@ -48,6 +54,7 @@ func (b *BackendHTTPReader) start() {
 		case common.Close:
 			logrus.Debugf("BACKEND CLOSE RECIEVED %s", b.msgKey)
 			closed = true
+			b.closeReason = common.ParseClose(message)
 			b.backend.closeConnection(b.hostKey, b.msgKey)
 		}
 	}
@@ -68,6 +75,7 @@ func (b *BackendHTTPReader) Read(out []byte) (int, error) {
 		message, ok := <-b.data
 		if !ok {
 			logrus.Debugf("BACKEND READ CHANNEL EOF: %s %s", b.hostKey, b.msgKey)
+			b.writeCloseReason()
 			return 0, io.EOF
 		}
 
@@ -90,6 +98,8 @@ func (b *BackendHTTPReader) Read(out []byte) (int, error) {
 		}
 
 		if response.Code > 0 && b.rw != nil {
+			httpPipeLatencyMetric.Observe(time.Since(b.opened).Seconds())
+			b.wroteHeader = true
 			logrus.Debugf("BACKEND READ STATUS CODE: %s %s %d", b.hostKey, b.msgKey, response.Code)
 			b.rw.WriteHeader(response.Code)
 			flush(b.rw)
@@ -101,3 +111,18 @@ func (b *BackendHTTPReader) Read(out []byte) (int, error) {
 	logrus.Debugf("BACKEND READ %s: %s buffer: %s", b.msgKey, out[:c], b.buffer)
 	return c, nil
 }
+
+// writeCloseReason turns a stream that the backend closed abnormally into an HTTP error, if the
+// response hasn't started yet.
+func (b *BackendHTTPReader) writeCloseReason() {
+	status := b.closeReason.HTTPStatus()
+	if status == 0 {
+		return
+	}
+	if b.wroteHeader || b.hijacked || b.rw == nil {
+		logrus.Warnf("Backend %s closed stream %s after the response started: %d %s", b.hostKey, b.msgKey, b.closeReason.Code, b.closeReason.Reason)
+		return
+	}
+	b.wroteHeader = true
+	http.Error(b.rw, b.closeReason.Reason, status)
+}
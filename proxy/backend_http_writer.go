@@ -78,7 +78,7 @@ func (b *BackendHTTPWriter) writeMessage(message *common.HTTPMessage) error {
 	}
 
 	logrus.Debugf("BACKEND WRITE %s,%s: %s", b.hostKey, b.msgKey, data)
-	return b.backend.send(b.hostKey, b.msgKey, string(data))
+	return b.backend.send(b.hostKey, b.msgKey, string(data), false)
 }
 
 func (b *BackendHTTPWriter) Write(buffer []byte) (int, error) {
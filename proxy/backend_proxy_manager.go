@@ -1,8 +1,10 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
@@ -11,106 +13,358 @@ import (
 )
 
 type backendProxy interface {
-	initializeClient(backendKey string) (string, <-chan common.Message, error)
+	initializeClient(backendKey, remote string) (string, <-chan common.Message, error)
 	connect(backendKey, msgKey, url string) error
-	send(backendKey, msgKey, msg string) error
+	send(backendKey, msgKey, msg string, binary bool) error
 	closeConnection(backendKey, msgKey string) error
+	writeDone(backendKey, msgKey string) (bool, error)
 	hasBackend(backendKey string) bool
 }
 
 type proxyManager interface {
 	addBackend(backendKey string, ws *websocket.Conn)
-	removeBackend(backendKey, sessionID string)
-	closeConnection(backendKey, msgKey string) error
+	removeBackend(backendKey, sessionID, reason string)
+	park(backendKey string, s *stream)
+	resume(backendKey, msgKey string, m *multiplexer) *stream
 }
 
+// backendProxyManager tracks the links of every backend. A backend may hold several links at once,
+// for throughput or to replace its connection without dropping streams. New streams go to the
+// least loaded healthy link, and each stream stays on its link until it ends.
 type backendProxyManager struct {
-	multiplexers map[string]*multiplexer
-	mu           *sync.RWMutex
+	multiplexers   map[string][]*multiplexer
+	mu             *sync.RWMutex
+	windowSize     int
+	maxFrameSize   int
+	maxMessageSize int
+	compression    *common.Compression
+	reverse        *reverseRouter
+	// errorBudget is how many protocol errors a backend may make before it is disconnected. Zero
+	// means defaultErrorBudget, negative never disconnects.
+	errorBudget int
+	gracePeriod time.Duration
+	// pingInterval is how often backends are pinged, zero means backendPingInterval.
+	pingInterval    time.Duration
+	livenessTimeout time.Duration
+	// maxLinks is how many links a backend may hold. Past it the oldest is drained, zero means no
+	// limit.
+	maxLinks int
+	// resumeGrace is how long the streams of a backend that lost its link are kept for it to resume,
+	// zero to close them right away. replayBufferSize bounds what is kept for each.
+	resumeGrace      time.Duration
+	replayBufferSize int
+	parked           map[string]map[string]*parkedStream
+	// registry, if set, tells the other replicas of a cluster which backends are attached here.
+	registry registry
+	// events, if set, is told when links are connected, replaced and disconnected.
+	events   *eventBus
+	draining bool
 }
 
-func (b *backendProxyManager) initializeClient(backendKey string) (string, <-chan common.Message, error) {
+const (
+	backendPingInterval = 5 * time.Second
+	defaultErrorBudget  = 10
+)
+
+// get picks the link of a backend that a new stream should use: one that isn't draining, then one
+// that has been heard from recently, then the one with the fewest streams, then the newest. Callers
+// must not hold b.mu while using it, since sending to a backend can block on flow control.
+func (b *backendProxyManager) get(backendKey string) (*multiplexer, error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	multiplexer, ok := b.multiplexers[backendKey]
-	if !ok {
-		return "", nil, fmt.Errorf("No backend for key [%v]", backendKey)
+	var best *multiplexer
+	for _, m := range b.multiplexers[backendKey] {
+		if best == nil || m.preferredTo(best) {
+			best = m
+		}
 	}
-	msgKey, msgChan := multiplexer.initializeClient()
-	return msgKey, msgChan, nil
+	if best == nil {
+		return nil, fmt.Errorf("No backend for key [%v]", backendKey)
+	}
+	return best, nil
 }
 
-func (b *backendProxyManager) connect(backendKey, msgKey, url string) error {
+// lookup finds the link of a backend that carries a stream.
+func (b *backendProxyManager) lookup(backendKey, msgKey string) (*multiplexer, error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	multiplexer, ok := b.multiplexers[backendKey]
+	links, ok := b.multiplexers[backendKey]
 	if !ok {
-		return fmt.Errorf("No backend for key [%v]", backendKey)
+		return nil, fmt.Errorf("No backend for key [%v]", backendKey)
 	}
-	multiplexer.connect(msgKey, url)
-	return nil
+	for _, m := range links {
+		if m.stream(msgKey) != nil {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("No stream %v on backend [%v]", msgKey, backendKey)
 }
 
-func (b *backendProxyManager) send(backendKey, msgKey, msg string) error {
+// stream finds a stream of a backend, whether it is on one of the backend's links or parked.
+func (b *backendProxyManager) stream(backendKey, msgKey string) (*stream, error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	multiplexer, ok := b.multiplexers[backendKey]
-	if !ok {
-		return fmt.Errorf("No backend for key [%v]", backendKey)
+	for _, m := range b.multiplexers[backendKey] {
+		if s := m.stream(msgKey); s != nil {
+			return s, nil
+		}
 	}
-	multiplexer.send(msgKey, msg)
-	return nil
+	if parked, ok := b.parked[backendKey][msgKey]; ok {
+		return parked.stream, nil
+	}
+	return nil, fmt.Errorf("No stream %v on backend [%v]", msgKey, backendKey)
 }
 
-func (b *backendProxyManager) closeConnection(backendKey, msgKey string) error {
+// all returns every link of every backend.
+func (b *backendProxyManager) all() []*multiplexer {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	multiplexer, ok := b.multiplexers[backendKey]
-	if !ok {
-		return fmt.Errorf("No backend for key [%v]", backendKey)
+	var all []*multiplexer
+	for _, links := range b.multiplexers {
+		all = append(all, links...)
+	}
+	return all
+}
+
+func (b *backendProxyManager) initializeClient(backendKey, remote string) (string, <-chan common.Message, error) {
+	multiplexer, err := b.get(backendKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if multiplexer.isDraining() {
+		return "", nil, common.CloseReason{Code: common.CloseUnavailable, Reason: multiplexer.drainReason}
+	}
+	msgKey, msgChan := multiplexer.initializeClient(remote)
+	return msgKey, msgChan, nil
+}
+
+func (b *backendProxyManager) connect(backendKey, msgKey, url string) error {
+	multiplexer, err := b.lookup(backendKey, msgKey)
+	if err != nil {
+		return err
+	}
+	multiplexer.connect(msgKey, url)
+	return nil
+}
+
+func (b *backendProxyManager) send(backendKey, msgKey, msg string, binary bool) error {
+	s, err := b.stream(backendKey, msgKey)
+	if err != nil {
+		return err
+	}
+	s.send(common.Message{Key: msgKey, Type: common.Body, Body: msg, Binary: binary})
+	return nil
+}
+
+func (b *backendProxyManager) closeConnection(backendKey, msgKey string) error {
+	s, err := b.stream(backendKey, msgKey)
+	if err != nil {
+		return err
+	}
+	if multiplexer := s.link(); multiplexer != nil {
+		multiplexer.closeConnection(msgKey, true)
+	} else if b.unpark(backendKey, msgKey) != nil {
+		s.close()
 	}
-	multiplexer.closeConnection(msgKey, true)
 	return nil
 }
 
+// writeDone tells the backend the frontend has finished sending on a stream. It returns false if
+// the backend doesn't support half-closed streams, in which case the caller should close the stream.
+func (b *backendProxyManager) writeDone(backendKey, msgKey string) (bool, error) {
+	s, err := b.stream(backendKey, msgKey)
+	if err != nil {
+		return false, err
+	}
+	// Parked streams are on links that could be resumed, which support half-closing too
+	if multiplexer := s.link(); multiplexer != nil && !multiplexer.capabilities().Supports(common.WriteDone) {
+		return false, nil
+	}
+	s.send(common.Message{Key: msgKey, Type: common.WriteDone})
+	return true, nil
+}
+
 func (b *backendProxyManager) hasBackend(backendKey string) bool {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	_, ok := b.multiplexers[backendKey]
-	return ok
+	_, err := b.get(backendKey)
+	return err == nil
 }
 
 func (b *backendProxyManager) addBackend(backendKey string, ws *websocket.Conn) {
 	sessionID := uuid.New()
-	logrus.Infof("Registering backend for host %v with session ID %v.", backendKey, sessionID)
+	logrus.Infof("Registering backend for host %v with session ID %v. Protocol: %q.", backendKey, sessionID, ws.Subprotocol())
+
+	b.mu.RLock()
+	draining := b.draining
+	b.mu.RUnlock()
+	if draining {
+		logrus.Infof("Refusing backend for host %v, the proxy is shutting down.", backendKey)
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(common.CloseGoingAway, "proxy is shutting down"),
+			time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
 
-	msgs := make(chan string, 10)
-	clients := make(map[string]chan<- common.Message)
 	m := &multiplexer{
-		backendSessionID:  sessionID,
-		backendKey:        backendKey,
-		messagesToBackend: msgs,
-		frontendChans:     clients,
-		proxyManager:      b,
-		frontendMu:        &sync.RWMutex{},
+		backendSessionID: sessionID,
+		backendKey:       backendKey,
+		protocol:         ws.Subprotocol(),
+		windowSize:       b.windowSize,
+		maxFrameSize:     b.maxFrameSize,
+		maxMessageSize:   b.maxMessageSize,
+		compression:      b.compression,
+		reverse:          b.reverse,
+		errorBudget:      b.errorBudget,
+		gracePeriod:      b.gracePeriod,
+		pingInterval:     b.pingInterval,
+		livenessTimeout:  b.livenessTimeout,
+		resumeGrace:      b.resumeGrace,
+		replayBufferSize: b.replayBufferSize,
+		ws:               ws,
+		remoteAddr:       ws.RemoteAddr().String(),
+		connected:        time.Now(),
+		draining:         make(chan struct{}),
+		scheduler:        common.NewScheduler(),
+		streams:          make(map[string]*stream),
+		proxyManager:     b,
+		streamsMu:        &sync.RWMutex{},
+		helloMu:          &sync.Mutex{},
 	}
-	m.routeMessages(ws)
+	if m.pingInterval <= 0 {
+		m.pingInterval = backendPingInterval
+	}
+	if m.errorBudget == 0 {
+		m.errorBudget = defaultErrorBudget
+	}
+	m.touch()
 
+	// The link is recorded before it starts reading, so that removeBackend finds it however soon
+	// the connection fails
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.multiplexers[backendKey] = m
+	links := append(b.multiplexers[backendKey], m)
+	b.multiplexers[backendKey] = links
+	attached := len(links) == 1
+	var replaced *multiplexer
+	if b.maxLinks > 0 && len(links) > b.maxLinks {
+		for _, link := range links {
+			if !link.isDraining() {
+				replaced = link
+				break
+			}
+		}
+	}
+	backendLinksMetric.Inc()
+	if attached {
+		backendsMetric.Inc()
+	}
+	if attached && b.registry != nil {
+		b.registry.attach(backendKey)
+	}
+	b.events.publish(backendEvent{
+		Type:       backendConnected,
+		HostKey:    backendKey,
+		SessionID:  sessionID,
+		RemoteAddr: m.remoteAddr,
+	})
+	b.mu.Unlock()
+
+	m.routeMessages(ws)
+	if replaced != nil {
+		logrus.Infof("Backend %v has more than %v links. Replacing the oldest, session ID %v.", backendKey, b.maxLinks, replaced.backendSessionID)
+		reason := "replaced by a newer connection"
+		b.events.publish(backendEvent{
+			Type:       backendReplaced,
+			HostKey:    backendKey,
+			SessionID:  replaced.backendSessionID,
+			RemoteAddr: replaced.remoteAddr,
+			Reason:     reason,
+		})
+		replaced.drain(reason, true)
+	}
 }
 
-func (b *backendProxyManager) removeBackend(backendKey, sessionID string) {
+// rtt returns the smoothed round trip time to a backend, if it is connected and has answered a ping.
+// For backends with several links it is that of the fastest.
+func (b *backendProxyManager) rtt(backendKey string) (time.Duration, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var best time.Duration
+	for _, m := range b.multiplexers[backendKey] {
+		if rtt := m.smoothedRTT(); rtt > 0 && (best == 0 || rtt < best) {
+			best = rtt
+		}
+	}
+	return best, best > 0
+}
+
+// removeBackend forgets a link that was lost for reason.
+func (b *backendProxyManager) removeBackend(backendKey, sessionID, reason string) {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	if m, ok := b.multiplexers[backendKey]; ok {
-		if m.backendSessionID == sessionID {
+	links := b.multiplexers[backendKey]
+	for i, m := range links {
+		if m.backendSessionID != sessionID {
+			continue
+		}
+		if len(links) == 1 {
 			delete(b.multiplexers, backendKey)
-			logrus.Infof("Removed backend. Key: %v. Session ID %v .", backendKey, sessionID)
 		} else {
-			logrus.Infof("Not removing backend for key %v. The provided session ID %v doesn't match registered session ID %v.",
-				backendKey, sessionID, m.backendSessionID)
+			remaining := make([]*multiplexer, 0, len(links)-1)
+			remaining = append(remaining, links[:i]...)
+			b.multiplexers[backendKey] = append(remaining, links[i+1:]...)
+		}
+		b.mu.Unlock()
+		logrus.Infof("Removed backend. Key: %v. Session ID %v. Remaining links: %v.", backendKey, sessionID, len(links)-1)
+		backendLinksMetric.Dec()
+		if len(links) == 1 {
+			backendsMetric.Dec()
+		}
+		if len(links) == 1 && b.registry != nil {
+			b.registry.detach(backendKey)
+		}
+		b.events.publish(backendEvent{
+			Type:       backendDisconnected,
+			HostKey:    backendKey,
+			SessionID:  sessionID,
+			RemoteAddr: m.remoteAddr,
+			Reason:     reason,
+		})
+		return
+	}
+	b.mu.Unlock()
+	logrus.Infof("Not removing backend for key %v. No link has session ID %v.", backendKey, sessionID)
+}
+
+// drain tells every backend the proxy is shutting down and waits for their links to close, which
+// they do once their streams have finished or the grace period has passed. Links still open when
+// ctx is done are closed.
+func (b *backendProxyManager) drain(ctx context.Context) error {
+	b.mu.Lock()
+	b.draining = true
+	b.mu.Unlock()
+	multiplexers := b.all()
+
+	for _, m := range multiplexers {
+		m.drain("proxy is shutting down", true)
+	}
+	// Draining links don't park their streams, and those already parked won't be resumed
+	b.closeParked("proxy is shutting down")
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		b.mu.RLock()
+		remaining := len(b.multiplexers)
+		b.mu.RUnlock()
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, m := range multiplexers {
+				m.ws.Close()
+			}
+			return ctx.Err()
+		case <-ticker.C:
 		}
 	}
 }
@@ -0,0 +1,468 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/websocket-proxy/common"
+	"github.com/rancher/websocket-proxy/proxy/websocket"
+)
+
+const (
+	// peerSignatureHeader carries "address timestamp signature" on requests between replicas, see
+	// cluster.sign.
+	peerSignatureHeader = "X-Websocket-Proxy-Peer"
+	peerSignatureMaxAge = time.Minute
+	// clusterBackendsPath is where replicas announce their backends to their peers.
+	clusterBackendsPath = "/v1/cluster/backends"
+	clusterSyncInterval = 10 * time.Second
+	clusterPeerTimeout  = 5 * time.Second
+	// unsignedBody stands in for the body digest of forwarded requests, whose bodies are streamed
+	// through unread.
+	unsignedBody = "UNSIGNED-BODY"
+)
+
+// cluster lets several replicas of the proxy run behind a load balancer. Each records the backends
+// attached to it in a registry shared with the others, and a replica asked for a backend it doesn't
+// have forwards the request to the peer that does. Requests between replicas are signed with a
+// secret they share, so a peer can trust them and won't forward them again.
+type cluster struct {
+	// address is the URL peers reach this replica at.
+	address  string
+	secret   []byte
+	registry registry
+}
+
+// registry records which replica each backend is attached to.
+type registry interface {
+	attach(hostKey string)
+	detach(hostKey string)
+	// owner returns the address of the replica hostKey is attached to.
+	owner(hostKey string) (string, bool)
+	// stop ends any work the registry does in the background.
+	stop()
+}
+
+// remoteBackendError is returned by a frontend's auth when its backend is attached to a peer.
+type remoteBackendError struct {
+	hostKey string
+	peer    string
+}
+
+func (e remoteBackendError) Error() string {
+	return fmt.Sprintf("Backend %v is attached to peer %v", e.hostKey, e.peer)
+}
+
+// newCluster returns nil if the replica isn't configured to be part of a cluster.
+func newCluster(config *Config) (*cluster, error) {
+	if config.ClusterAddress == "" {
+		return nil, nil
+	}
+	if len(config.ClusterSecret) == 0 {
+		return nil, fmt.Errorf("A cluster secret is required to sign requests between replicas")
+	}
+	if config.ClusterRegistryFile != "" && len(config.ClusterPeers) > 0 {
+		return nil, fmt.Errorf("Can't specify both cluster-peers and cluster-registry-file")
+	}
+
+	c := &cluster{
+		address: strings.TrimSuffix(config.ClusterAddress, "/"),
+		secret:  config.ClusterSecret,
+	}
+	if config.ClusterRegistryFile != "" {
+		c.registry = &fileRegistry{path: config.ClusterRegistryFile, self: c.address}
+	} else {
+		c.registry = newPeerRegistry(c, config.ClusterPeers)
+	}
+	return c, nil
+}
+
+// owner returns the peer a backend that isn't attached here is attached to. Requests forwarded by
+// a peer aren't forwarded again, even if the registry disagrees with the peer.
+func (c *cluster) owner(req *http.Request, hostKey string) (string, bool) {
+	if c == nil || req.Header.Get(peerSignatureHeader) != "" {
+		return "", false
+	}
+	peer, ok := c.registry.owner(hostKey)
+	if !ok || peer == c.address {
+		return "", false
+	}
+	return peer, true
+}
+
+func (c *cluster) stop() {
+	if c != nil {
+		c.registry.stop()
+	}
+}
+
+// forward passes a frontend's request on to the peer its backend is attached to. Websockets are
+// piped through as they are, other requests are reverse proxied.
+func (c *cluster) forward(rw http.ResponseWriter, req *http.Request, peer string) {
+	target, err := url.Parse(peer)
+	if err != nil {
+		log.Errorf("Invalid peer address %v: %v", peer, err)
+		http.Error(rw, "Invalid peer", 502)
+		return
+	}
+
+	log.Infof("Forwarding %v to peer %v.", req.URL.Path, peer)
+	c.sign(req, unsignedBody)
+	if websocket.ShouldProxy(req) {
+		websocket.Proxy(target.Scheme, hostPort(target), rw, req)
+		return
+	}
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(rw, req)
+}
+
+// sign marks a request as coming from this replica. The signature covers the replica's address,
+// the time, the request line and digest, the bodyDigest of the request's body or unsignedBody, and
+// is only valid for peerSignatureMaxAge.
+func (c *cluster) sign(req *http.Request, digest string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(peerSignatureHeader, strings.Join([]string{c.address, timestamp, c.signature(c.address, timestamp, digest, req)}, " "))
+}
+
+func (c *cluster) signature(address, timestamp, digest string, req *http.Request) string {
+	mac := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", address, timestamp, req.Method, req.URL.RequestURI(), digest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bodyDigest is the SHA-256 of a request body that a signature covers.
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// peer returns the address of the replica that signed a request whose body has digest, or "" if
+// the request isn't signed. It fails if the signature is invalid or has expired.
+func (c *cluster) peer(req *http.Request, digest string) (string, error) {
+	value := req.Header.Get(peerSignatureHeader)
+	if value == "" {
+		return "", nil
+	}
+	if c == nil {
+		return "", fmt.Errorf("Request claims to be from a peer but clustering is disabled")
+	}
+
+	parts := strings.Split(value, " ")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("Malformed peer signature %q", value)
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Malformed peer signature timestamp %q", parts[1])
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > peerSignatureMaxAge || age < -peerSignatureMaxAge {
+		return "", fmt.Errorf("Peer signature from %v has expired", parts[0])
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(c.signature(parts[0], parts[1], digest, req))) {
+		return "", fmt.Errorf("Invalid peer signature from %v", parts[0])
+	}
+	return parts[0], nil
+}
+
+func hostPort(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Host, "443")
+	}
+	return net.JoinHostPort(u.Host, "80")
+}
+
+// peerRegistry shares the backends attached to each replica with a static list of peers. Every
+// replica announces its full list to the others whenever it changes and every clusterSyncInterval,
+// and forgets what a peer announced if it hasn't heard from it for three intervals.
+type peerRegistry struct {
+	cluster *cluster
+	peers   []string
+	client  *http.Client
+	mu      sync.Mutex
+	local   map[string]bool
+	remote  map[string]peerBackends
+	changed chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+type peerBackends struct {
+	hostKeys map[string]bool
+	expires  time.Time
+}
+
+// announcement is the body of a replica's POST to clusterBackendsPath.
+type announcement struct {
+	Address  string   `json:"address"`
+	HostKeys []string `json:"hostKeys"`
+}
+
+func newPeerRegistry(c *cluster, peers []string) *peerRegistry {
+	r := &peerRegistry{
+		cluster: c,
+		client:  &http.Client{Timeout: clusterPeerTimeout},
+		local:   make(map[string]bool),
+		remote:  make(map[string]peerBackends),
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	for _, peer := range peers {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" && peer != c.address {
+			r.peers = append(r.peers, peer)
+		}
+	}
+	go r.run()
+	return r
+}
+
+func (r *peerRegistry) attach(hostKey string) {
+	r.mu.Lock()
+	r.local[hostKey] = true
+	r.mu.Unlock()
+	common.Signal(r.changed)
+}
+
+func (r *peerRegistry) detach(hostKey string) {
+	r.mu.Lock()
+	delete(r.local, hostKey)
+	r.mu.Unlock()
+	common.Signal(r.changed)
+}
+
+func (r *peerRegistry) owner(hostKey string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for peer, backends := range r.remote {
+		if backends.hostKeys[hostKey] && now.Before(backends.expires) {
+			return peer, true
+		}
+	}
+	return "", false
+}
+
+// stop ends the announcements. Peers forget this replica's backends once they expire.
+func (r *peerRegistry) stop() {
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
+
+func (r *peerRegistry) run() {
+	ticker := time.NewTicker(clusterSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.changed:
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+		r.announce()
+	}
+}
+
+// announce sends the backends attached here to every peer.
+func (r *peerRegistry) announce() {
+	r.mu.Lock()
+	a := announcement{Address: r.cluster.address}
+	for hostKey := range r.local {
+		a.HostKeys = append(a.HostKeys, hostKey)
+	}
+	r.mu.Unlock()
+	body, err := json.Marshal(a)
+	if err != nil {
+		log.Errorf("Failed to encode backends for peers: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, peer := range r.peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if err := r.post(peer, body); err != nil {
+				log.Warnf("Failed to announce backends to peer %v: %v", peer, err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (r *peerRegistry) post(peer string, body []byte) error {
+	req, err := http.NewRequest("POST", peer+clusterBackendsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	r.cluster.sign(req, bodyDigest(body))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Unexpected response %v", resp.Status)
+	}
+	return nil
+}
+
+// ServeHTTP receives a peer's announcement.
+func (r *peerRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, "Failed to read announcement", 400)
+		return
+	}
+	peer, err := r.cluster.peer(req, bodyDigest(body))
+	if err != nil || peer == "" {
+		log.Warnf("Refusing backends announced by an unauthenticated peer: %v", err)
+		authFailuresMetric.WithLabelValues(authPeerSignature).Inc()
+		http.Error(rw, "Failed authentication", 401)
+		return
+	}
+
+	var a announcement
+	if err := json.Unmarshal(body, &a); err != nil || a.Address != peer {
+		http.Error(rw, "Invalid announcement", 400)
+		return
+	}
+	backends := peerBackends{
+		hostKeys: make(map[string]bool),
+		expires:  time.Now().Add(3 * clusterSyncInterval),
+	}
+	for _, hostKey := range a.HostKeys {
+		backends.hostKeys[hostKey] = true
+	}
+
+	r.mu.Lock()
+	r.remote[peer] = backends
+	r.mu.Unlock()
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// fileRegistry records where backends are attached in a JSON file shared by replicas on one
+// machine, for local testing. Entries of replicas that died aren't cleaned up. Replicas take turns
+// changing the file by locking path.lock next to it, see lock.
+type fileRegistry struct {
+	path string
+	self string
+	mu   sync.Mutex
+}
+
+func (r *fileRegistry) attach(hostKey string) {
+	r.update(func(entries map[string]string) {
+		entries[hostKey] = r.self
+	})
+}
+
+func (r *fileRegistry) detach(hostKey string) {
+	r.update(func(entries map[string]string) {
+		if entries[hostKey] == r.self {
+			delete(entries, hostKey)
+		}
+	})
+}
+
+func (r *fileRegistry) owner(hostKey string) (string, bool) {
+	entries, err := r.read()
+	if err != nil {
+		log.Warnf("Failed to read cluster registry %v: %v", r.path, err)
+		return "", false
+	}
+	owner, ok := entries[hostKey]
+	return owner, ok
+}
+
+func (r *fileRegistry) stop() {}
+
+func (r *fileRegistry) read() (map[string]string, error) {
+	entries := make(map[string]string)
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return entries, nil
+	}
+	return entries, json.Unmarshal(data, &entries)
+}
+
+// lock takes an exclusive flock on the registry's lock file, so replicas don't overwrite each
+// other's changes. The registry file itself can't be locked, as update replaces it.
+func (r *fileRegistry) lock() (*os.File, error) {
+	f, err := os.OpenFile(r.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// update rewrites the file with a change, replacing it in one rename so readers never see it half
+// written.
+func (r *fileRegistry) update(change func(entries map[string]string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lock, err := r.lock()
+	if err != nil {
+		log.Warnf("Failed to lock cluster registry %v: %v", r.path, err)
+		return
+	}
+	// Closing the file releases the lock
+	defer lock.Close()
+
+	entries, err := r.read()
+	if err != nil {
+		log.Warnf("Failed to read cluster registry %v: %v", r.path, err)
+		return
+	}
+	change(entries)
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		log.Errorf("Failed to encode cluster registry: %v", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".")
+	if err != nil {
+		log.Warnf("Failed to update cluster registry %v: %v", r.path, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.path)
+	}
+	if err != nil {
+		log.Warnf("Failed to update cluster registry %v: %v", r.path, err)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+// upgrade upgrades a request to a websocket, offering compression unless compression is nil.
+func upgrade(upgrader websocket.Upgrader, compression *common.Compression, rw http.ResponseWriter, req *http.Request, responseHeader http.Header) (*websocket.Conn, error) {
+	if compression == nil {
+		return upgrader.Upgrade(rw, req, responseHeader)
+	}
+
+	upgrader.EnableCompression = true
+	ws, err := upgrader.Upgrade(&countingResponseWriter{rw}, req, responseHeader)
+	if err != nil {
+		return nil, err
+	}
+	if err := compression.Start(ws, common.Negotiated(req.Header)); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// countingResponseWriter hands the upgrader a connection that can count the bytes sent over it.
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Response does not implement http.Hijacker")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &common.CountingConn{Conn: conn}, brw, nil
+}
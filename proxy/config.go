@@ -14,8 +14,10 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rancher/go-rancher/v3"
+	"github.com/rancher/websocket-proxy/common"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rakyll/globalconf"
@@ -32,6 +34,28 @@ type Config struct {
 	TLSListenAddr            string
 	MasterFile               string
 	APIInterceptorConfigFile string
+	StreamWindowSize         int
+	MaxFrameSize             int
+	MaxMessageSize           int
+	Compression              bool
+	CompressionLevel         int
+	CompressionThreshold     int
+	ReverseDestinations      map[string]string
+	ProtocolErrorBudget      int
+	DrainGracePeriod         time.Duration
+	BackendLivenessTimeout   time.Duration
+	MaxBackendLinks          int
+	ResumeGracePeriod        time.Duration
+	ResumeBufferSize         int
+	ClusterAddress           string
+	ClusterPeers             []string
+	ClusterRegistryFile      string
+	ClusterSecret            []byte
+	AdminListenAddr          string
+	AdminToken               string
+	EventWebhooks            []string
+	EventWebhookSecret       string
+	EventWebhookRetries      int
 }
 
 func GetConfig() (*Config, error) {
@@ -43,6 +67,10 @@ func GetConfig() (*Config, error) {
 	var keyContents string
 	var proxyProtoHTTPSPorts string
 	var apiInterceptorConfigFile string
+	var reverseDestinations string
+	var clusterPeers string
+	var clusterSecret string
+	var eventWebhooks string
 
 	flag.StringVar(&c.MasterFile, "master-file", "", "Location of the file containing the master address.")
 	flag.StringVar(&keyFile, "jwt-public-key-file", "", "Location of the public-key used to validate JWTs.")
@@ -53,6 +81,28 @@ func GetConfig() (*Config, error) {
 	flag.IntVar(&c.ParentPid, "parent-pid", 0, "If provided, this process will exit when the specified parent process stops running.")
 	flag.StringVar(&proxyProtoHTTPSPorts, "https-proxy-protocol-ports", "", "If proxy protocol is used, a list of proxy ports that will allow us to recognize that the connection was over https.")
 	flag.StringVar(&apiInterceptorConfigFile, "api-interceptor-config-file", "", "Location of the config.json that defines the API interceptors.")
+	flag.StringVar(&reverseDestinations, "reverse-destinations", "", "A list of name=host:port destinations that agents may open streams to through the proxy.")
+	flag.IntVar(&c.MaxFrameSize, "max-frame-size", common.DefaultMaxFrameSize, "The largest message body accepted from backends that support fragmentation. Larger bodies are split.")
+	flag.IntVar(&c.MaxMessageSize, "max-message-size", common.DefaultMaxMessageSize, "The largest message body that may be reassembled from fragments.")
+	flag.BoolVar(&c.Compression, "compression", true, "Negotiate per-message deflate with backends and frontends that offer it.")
+	flag.IntVar(&c.CompressionLevel, "compression-level", common.DefaultCompressionLevel, "The deflate level (1-9) for compressed messages.")
+	flag.IntVar(&c.CompressionThreshold, "compression-threshold", common.DefaultCompressionThreshold, "Messages smaller than this many bytes are sent uncompressed.")
+	flag.DurationVar(&c.DrainGracePeriod, "drain-grace-period", 30*time.Second, "How long open streams may run once a backend or the proxy starts shutting down.")
+	flag.DurationVar(&c.BackendLivenessTimeout, "backend-liveness-timeout", 30*time.Second, "Backends that send nothing, not even a pong to the pings sent every 5s, for this long are disconnected. Zero to never disconnect.")
+	flag.IntVar(&c.MaxBackendLinks, "max-backend-links", 4, "Connections a backend may hold at once. The oldest is drained when a backend opens more. Zero for no limit.")
+	flag.DurationVar(&c.ResumeGracePeriod, "resume-grace-period", 30*time.Second, "How long the streams of a backend that lost its connection are kept for it to resume when it reconnects. Zero to close them right away.")
+	flag.IntVar(&c.ResumeBufferSize, "resume-buffer-size", common.DefaultReplayBufferSize, "Bytes sent on a stream that are kept to replay if the stream is resumed.")
+	flag.IntVar(&c.ProtocolErrorBudget, "protocol-error-budget", defaultErrorBudget, "Protocol errors tolerated from a backend before it is disconnected. Zero for the default, negative to never disconnect.")
+	flag.StringVar(&c.ClusterAddress, "cluster-address", "", "The URL other replicas reach this one at, such as http://10.0.0.5:8080. Setting it makes the proxy forward frontends for backends attached to other replicas.")
+	flag.StringVar(&clusterPeers, "cluster-peers", "", "A comma separated list of the URLs of the other replicas.")
+	flag.StringVar(&c.ClusterRegistryFile, "cluster-registry-file", "", "A file replicas on one machine share to record where backends are attached, instead of cluster-peers. For local testing.")
+	flag.StringVar(&clusterSecret, "cluster-secret", "", "The secret replicas share to sign the requests between them.")
+	flag.StringVar(&c.AdminListenAddr, "admin-listen-address", "", "The tcp address to serve the admin API and metrics on. Both are disabled if this option is not provided.")
+	flag.StringVar(&c.AdminToken, "admin-token", "", "The bearer token admin API requests must carry.")
+	flag.StringVar(&eventWebhooks, "event-webhooks", "", "A comma separated list of URLs that backends connecting, being replaced and disconnecting are posted to.")
+	flag.StringVar(&c.EventWebhookSecret, "event-webhook-secret", "", "If set, the secret event webhook requests are signed with, like API interceptor requests.")
+	flag.IntVar(&c.EventWebhookRetries, "event-webhook-retries", 5, "How many times delivering an event to a webhook is retried before it is given up.")
+	flag.IntVar(&c.StreamWindowSize, "stream-window-size", common.DefaultWindowSize, "Bytes a backend may send on a stream before the frontend consumes them, for backends that support flow control.")
 
 	confOptions := &globalconf.Options{
 		EnvPrefix: "PROXY_",
@@ -100,9 +150,48 @@ func GetConfig() (*Config, error) {
 	c.ProxyProtoHTTPSPorts = portMap
 	c.APIInterceptorConfigFile = apiInterceptorConfigFile
 
+	c.ReverseDestinations = make(map[string]string)
+	for _, destination := range strings.Split(reverseDestinations, ",") {
+		parts := strings.SplitN(strings.TrimSpace(destination), "=", 2)
+		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			c.ReverseDestinations[parts[0]] = parts[1]
+		} else if destination != "" {
+			return nil, fmt.Errorf("Invalid reverse destination %q, expected name=host:port", destination)
+		}
+	}
+
+	for _, peer := range strings.Split(clusterPeers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			c.ClusterPeers = append(c.ClusterPeers, peer)
+		}
+	}
+	c.ClusterSecret = []byte(clusterSecret)
+
+	for _, webhook := range strings.Split(eventWebhooks, ",") {
+		if webhook = strings.TrimSpace(webhook); webhook != "" {
+			c.EventWebhooks = append(c.EventWebhooks, webhook)
+		}
+	}
+
+	if c.AdminListenAddr != "" && c.AdminToken == "" {
+		return nil, fmt.Errorf("admin-token is required to serve the admin API")
+	}
+
 	return c, nil
 }
 
+// compression returns how links should be compressed, or nil if compression is disabled.
+func (config *Config) compression(stats *common.CompressionStats) *common.Compression {
+	if !config.Compression {
+		return nil
+	}
+	return &common.Compression{
+		Level:     config.CompressionLevel,
+		Threshold: config.CompressionThreshold,
+		Stats:     stats,
+	}
+}
+
 func (config *Config) GetCerts() (*Certs, error) {
 	return downloadCert(config.CattleAccessKey, config.CattleSecretKey, config.CattleAddr)
 }
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+
+	"github.com/rancher/websocket-proxy/common"
+	"github.com/rancher/websocket-proxy/proxy/apiinterceptor/filters"
+	"github.com/rancher/websocket-proxy/proxy/apiinterceptor/model"
+)
+
+// Types of backendEvent.
+const (
+	backendConnected    = "connected"
+	backendReplaced     = "replaced"
+	backendDisconnected = "disconnected"
+)
+
+const (
+	adminEventsPath = "/v1/admin/events"
+	// eventHeader names the type of the event a webhook is delivering.
+	eventHeader = "X-Websocket-Proxy-Event"
+
+	eventSubscriberBuffer = 100
+	eventKeepAlive        = 30 * time.Second
+	webhookQueueLength    = 1000
+	webhookTimeout        = 10 * time.Second
+	webhookMaxBackoff     = time.Minute
+)
+
+// backendEvent is a change in a backend's links: one was connected, replaced by a newer one when the
+// backend opened more than it may hold, or disconnected.
+type backendEvent struct {
+	Type       string    `json:"type"`
+	HostKey    string    `json:"hostKey"`
+	SessionID  string    `json:"sessionId"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// eventBus passes backend events to the admin API's subscribers and to the configured webhooks.
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan backendEvent]struct{}
+	webhooks    []*webhook
+}
+
+func newEventBus(config *Config) *eventBus {
+	e := &eventBus{subscribers: make(map[chan backendEvent]struct{})}
+	for _, url := range config.EventWebhooks {
+		w := newWebhook(url, config.EventWebhookSecret, config.EventWebhookRetries)
+		go w.run()
+		e.webhooks = append(e.webhooks, w)
+	}
+	return e
+}
+
+// publish sends an event to every subscriber and webhook without waiting on them. Subscribers that
+// fall too far behind are dropped.
+func (e *eventBus) publish(event backendEvent) {
+	if e == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for events := range e.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Warnf("Dropping a subscriber to backend events that isn't keeping up.")
+			delete(e.subscribers, events)
+			close(events)
+		}
+	}
+	for _, w := range e.webhooks {
+		w.enqueue(event)
+	}
+}
+
+// subscribe returns a channel of the events published from now on, closed if the subscriber falls
+// behind, and a function to stop the subscription.
+func (e *eventBus) subscribe() (<-chan backendEvent, func()) {
+	events := make(chan backendEvent, eventSubscriberBuffer)
+	e.mu.Lock()
+	e.subscribers[events] = struct{}{}
+	e.mu.Unlock()
+
+	return events, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.subscribers[events]; ok {
+			delete(e.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// webhook delivers events to a URL in the order they happened. Each is posted as JSON, signed like
+// the API interceptor's requests if there is a secret, and retried with a growing delay until it is
+// accepted or retries run out.
+type webhook struct {
+	url     string
+	secret  []byte
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	queue   chan backendEvent
+}
+
+func newWebhook(url, secret string, retries int) *webhook {
+	return &webhook{
+		url:     url,
+		secret:  []byte(secret),
+		retries: retries,
+		backoff: time.Second,
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan backendEvent, webhookQueueLength),
+	}
+}
+
+func (w *webhook) enqueue(event backendEvent) {
+	select {
+	case w.queue <- event:
+	default:
+		log.Warnf("Dropping %v event of backend %v, webhook %v is too far behind.", event.Type, event.HostKey, w.url)
+		webhookDeliveriesMetric.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (w *webhook) run() {
+	for event := range w.queue {
+		w.deliver(event)
+	}
+}
+
+func (w *webhook) deliver(event backendEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Failed to encode backend event: %v", err)
+		return
+	}
+
+	delay := w.backoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(event.Type, body)
+		if err == nil {
+			webhookDeliveriesMetric.WithLabelValues("delivered").Inc()
+			return
+		}
+		if attempt >= w.retries {
+			log.Errorf("Giving up delivering %v event of backend %v to webhook %v after %v attempts: %v",
+				event.Type, event.HostKey, w.url, attempt+1, err)
+			webhookDeliveriesMetric.WithLabelValues("failed").Inc()
+			return
+		}
+		log.Warnf("Failed to deliver %v event of backend %v to webhook %v, retrying in %v: %v",
+			event.Type, event.HostKey, w.url, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > webhookMaxBackoff {
+			delay = webhookMaxBackoff
+		}
+	}
+}
+
+func (w *webhook) post(eventType string, body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if len(w.secret) > 0 {
+		req.Header.Set(model.SignatureHeader, filters.SignString(body, w.secret))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(eventHeader, eventType)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %v", resp.Status)
+	}
+	return nil
+}
+
+// events streams backend events to an admin, as JSON messages on a websocket if it asks for one and
+// as server-sent events otherwise.
+func (h *AdminHandler) events(rw http.ResponseWriter, req *http.Request) {
+	if h.backends.events == nil {
+		http.Error(rw, "Backend events are not available", 404)
+		return
+	}
+	events, unsubscribe := h.backends.events.subscribe()
+	defer unsubscribe()
+
+	log.Infof("Admin %v subscribed to backend events.", req.RemoteAddr)
+	if websocket.IsWebSocketUpgrade(req) {
+		streamEventsWebsocket(rw, req, events)
+	} else {
+		streamEventsSSE(rw, req, events)
+	}
+	log.Infof("Admin %v unsubscribed from backend events.", req.RemoteAddr)
+}
+
+func streamEventsWebsocket(rw http.ResponseWriter, req *http.Request, events <-chan backendEvent) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	ws, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		log.Errorf("Error during upgrade: [%v]", err)
+		return
+	}
+	defer closeConnection(ws)
+
+	// Nothing is expected from the subscriber, reading only notices when it goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				closeConnectionWithReason(ws, common.CloseReason{Code: common.CloseGoingAway, Reason: "subscriber fell behind"})
+				return
+			}
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := ws.WriteJSON(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+		case <-gone:
+			return
+		}
+	}
+}
+
+func streamEventsSSE(rw http.ResponseWriter, req *http.Request, events <-chan backendEvent) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming is not supported", 500)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(200)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Errorf("Failed to encode backend event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
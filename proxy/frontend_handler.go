@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	log "github.com/Sirupsen/logrus"
 	jwt "github.com/dgrijalva/jwt-go"
@@ -17,20 +18,40 @@ import (
 const wsProto string = "Sec-Websocket-Protocol"
 const wsProtoBinary string = "binary"
 
+// maxCloseReasonLength is what fits in a close frame after the code
+const maxCloseReasonLength = 123
+
+// halfCloseTimeout is how long a frontend that sent its close frame waits for the backend to
+// finish the stream before it is torn down.
+const halfCloseTimeout = 30 * time.Second
+
 type FrontendHandler struct {
 	backend         backendProxy
 	parsedPublicKey interface{}
+	compression     *common.Compression
+	// cluster, if set, is used to forward frontends for backends attached to other replicas.
+	cluster *cluster
 }
 
 func (h *FrontendHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	_, hostKey, authErr := h.auth(req)
-	if authErr != nil {
+	if remote, ok := authErr.(remoteBackendError); ok {
+		h.cluster.forward(rw, req, remote.peer)
+		return
+	} else if authErr != nil {
 		log.Infof("Frontend auth failed: %v", authErr)
+		authFailed(authErr)
 		http.Error(rw, "Failed authentication", 401)
 		return
 	}
 
 	binary := strings.EqualFold(req.Header.Get(wsProto), wsProtoBinary)
+	h.serve(rw, req, hostKey, req.URL.String(), binary)
+}
+
+// serve upgrades the frontend and connects it to url on the backend for hostKey. Messages to the
+// frontend are binary if binary is set, text otherwise.
+func (h *FrontendHandler) serve(rw http.ResponseWriter, req *http.Request, hostKey, url string, binary bool) {
 	respHeaders := make(http.Header)
 	if binary {
 		respHeaders.Add(wsProto, wsProtoBinary)
@@ -38,16 +59,25 @@ func (h *FrontendHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
-	ws, err := upgrader.Upgrade(rw, req, respHeaders)
+	ws, err := upgrade(upgrader, h.compression, rw, req, respHeaders)
 	if err != nil {
 		log.Errorf("Error during upgrade: [%v]", err)
 		http.Error(rw, "Failed to upgrade connection.", 500)
 		return
 	}
 	defer closeConnection(ws)
+	// A close frame from the frontend only means it is done writing. It is answered when the stream
+	// ends, see halfClose.
+	ws.SetCloseHandler(func(code int, text string) error {
+		return nil
+	})
 
-	msgKey, respChannel, err := h.backend.initializeClient(hostKey)
-	if err != nil {
+	msgKey, respChannel, err := h.backend.initializeClient(hostKey, req.RemoteAddr)
+	if reason, ok := err.(common.CloseReason); ok {
+		log.Infof("Refusing frontend for backend %v: %v", hostKey, reason.Reason)
+		closeConnectionWithReason(ws, reason)
+		return
+	} else if err != nil {
 		log.Errorf("Error during initialization: [%v]", err)
 		closeConnection(ws)
 		return
@@ -55,7 +85,9 @@ func (h *FrontendHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	defer h.backend.closeConnection(hostKey, msgKey)
 
 	// Send response messages to client
+	output := make(chan struct{})
 	go func() {
+		defer close(output)
 		defer closeConnection(ws)
 		for {
 			message, ok := <-respChannel
@@ -69,6 +101,9 @@ func (h *FrontendHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				msgType := 1
 				if binary {
 					msgType = 2
+				}
+				if binary && !message.Binary {
+					// Backends on the text protocol base64 encode binary streams
 					data, e = base64.StdEncoding.DecodeString(message.Body)
 					if e != nil {
 						log.Errorf("Error decoding message: %v", e)
@@ -80,68 +115,109 @@ func (h *FrontendHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				}
 
 				ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				if e := ws.WriteMessage(msgType, data); e != nil {
+				if e := h.compression.WriteMessage(ws, msgType, data); e != nil {
 					closeConnection(ws)
 				}
 			case common.Close:
-				closeConnection(ws)
+				closeConnectionWithReason(ws, common.ParseClose(message))
+			case common.WriteDone:
+				// The frontend may keep sending until it answers the close frame
+				writeCloseFrame(ws, common.CloseReason{Code: common.CloseNormal})
 			}
 		}
 	}()
 
-	url := req.URL.String()
 	if err = h.backend.connect(hostKey, msgKey, url); err != nil {
 		return
 	}
 
 	// Send request messages to backend
 	for {
-		msgType, msg, err := ws.ReadMessage()
+		msgType, msg, err := h.compression.ReadMessage(ws)
 		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				h.halfClose(hostKey, msgKey, output)
+			}
 			return
 		}
-		var data string
-		if binary {
-			data = base64.StdEncoding.EncodeToString(msg)
-		} else {
-			data = string(msg)
-		}
 		if msgType == websocket.BinaryMessage || msgType == websocket.TextMessage {
-			if err = h.backend.send(hostKey, msgKey, data); err != nil {
+			if err = h.backend.send(hostKey, msgKey, string(msg), binary); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// halfClose passes a frontend's close frame on to the backend as a WriteDone and waits for the
+// backend to finish sending. Backends that don't support half-closed streams are closed right away.
+func (h *FrontendHandler) halfClose(hostKey, msgKey string, output <-chan struct{}) {
+	if ok, err := h.backend.writeDone(hostKey, msgKey); !ok || err != nil {
+		return
+	}
+
+	timeout := time.NewTimer(halfCloseTimeout)
+	defer timeout.Stop()
+	select {
+	case <-output:
+	case <-timeout.C:
+		log.Infof("Backend didn't finish half-closed stream %v in %v. Closing it.", msgKey, halfCloseTimeout)
+	}
+}
+
 func (h *FrontendHandler) auth(req *http.Request) (*jwt.Token, string, error) {
 	token, tokenParam, err := parseToken(req, h.parsedPublicKey)
 	if err != nil {
 		if tokenParam == "" {
 			return nil, "", noAuthError{err: err.Error()}
 		}
-		return nil, "", fmt.Errorf("Error parsing token: %v. Token parameter: %v", err, tokenParam)
+		return nil, "", authError{authInvalidToken, fmt.Errorf("Error parsing token: %v. Token parameter: %v", err, tokenParam)}
 	}
 
 	if !token.Valid {
-		return nil, "", fmt.Errorf("Token not valid. Token parameter: %v", tokenParam)
+		return nil, "", authError{authInvalidToken, fmt.Errorf("Token not valid. Token parameter: %v", tokenParam)}
+	}
+	if _, err := h.cluster.peer(req, unsignedBody); err != nil {
+		return nil, "", authError{authPeerSignature, err}
 	}
 
 	hostUUID, found := token.Claims["hostUuid"]
 	if found {
-		if hostKey, ok := hostUUID.(string); ok && h.backend.hasBackend(hostKey) {
-			return token, hostKey, nil
+		if hostKey, ok := hostUUID.(string); ok {
+			if h.backend.hasBackend(hostKey) {
+				return token, hostKey, nil
+			}
+			if peer, ok := h.cluster.owner(req, hostKey); ok {
+				return token, hostKey, remoteBackendError{hostKey: hostKey, peer: peer}
+			}
 		}
 	}
 
-	return nil, "", fmt.Errorf("Invalid backend host requested: %v", hostUUID)
+	return nil, "", authError{authUnknownBackend, fmt.Errorf("Invalid backend host requested: %v", hostUUID)}
 }
 
 func closeConnection(ws *websocket.Conn) {
-	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	closeConnectionWithReason(ws, common.CloseReason{Code: common.CloseNormal})
+}
+
+// closeConnectionWithReason closes a frontend websocket with the code and reason a stream was closed with.
+func closeConnectionWithReason(ws *websocket.Conn, reason common.CloseReason) {
+	writeCloseFrame(ws, reason)
 	ws.Close()
 }
 
+func writeCloseFrame(ws *websocket.Conn, reason common.CloseReason) {
+	text := reason.Reason
+	if len(text) > maxCloseReasonLength {
+		// Cut on a rune boundary, clients fail the connection if the reason isn't valid UTF-8
+		cut := maxCloseReasonLength
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+	}
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(reason.WebsocketCode(), text), time.Now().Add(time.Second))
+}
+
 func parseToken(req *http.Request, parsedPublicKey interface{}) (*jwt.Token, string, error) {
 	tokenString := ""
 	if authHeader := req.Header.Get("Authorization"); authHeader != "" {
@@ -11,6 +11,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/dgrijalva/jwt-go"
 
+	"github.com/rancher/websocket-proxy/common"
 	"github.com/rancher/websocket-proxy/proxy/proxyprotocol"
 )
 
@@ -21,7 +22,10 @@ type FrontendHTTPHandler struct {
 }
 
 func (h *FrontendHTTPHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if err := h.serveHTTP(rw, req); err != nil {
+	err := h.serveHTTP(rw, req)
+	if reason, ok := err.(common.CloseReason); ok {
+		http.Error(rw, reason.Reason, reason.HTTPStatus())
+	} else if err != nil {
 		log.Errorf("Failed to handle %s %s: %v", req.Method, req.URL.String(), err)
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
@@ -30,13 +34,18 @@ func (h *FrontendHTTPHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 
 func (h *FrontendHTTPHandler) serveHTTP(rw http.ResponseWriter, req *http.Request) error {
 	token, hostKey, err := h.AuthAndLookup(req)
-	if IsNoAuthError(err) {
+	if remote, ok := err.(remoteBackendError); ok {
+		h.cluster.forward(rw, req, remote.peer)
+		return nil
+	} else if IsNoAuthError(err) {
+		authFailed(err)
 		redirect := *req.URL
 		redirect.RawQuery = "redirectTo=" + url.QueryEscape(req.URL.Path) + "#"
 		redirect.Path = "/login"
 		http.Redirect(rw, req, redirect.String(), 302)
 		return nil
 	} else if err != nil {
+		authFailed(err)
 		http.Error(rw, "Service unavailable", 503)
 		return nil
 	}
@@ -51,7 +60,7 @@ func (h *FrontendHTTPHandler) ServeRemoteHTTP(token *jwt.Token, hostKey string,
 	proxyprotocol.AddHeaders(req, h.HTTPSPorts)
 	proxyprotocol.AddForwardedFor(req)
 
-	reader, writer, err := NewHTTPPipe(rw, h.backend, hostKey)
+	reader, writer, err := NewHTTPPipe(rw, h.backend, hostKey, req.RemoteAddr)
 	if err != nil {
 		log.Errorf("Failed to construct pipe to backend %s: %v", hostKey, err)
 		return err
@@ -84,6 +93,7 @@ func (h *FrontendHTTPHandler) ServeRemoteHTTP(token *jwt.Token, hostKey string,
 		}
 		defer httpConn.Close()
 		defer buf.Flush()
+		reader.hijacked = true
 
 		input = buf
 		output = buf
@@ -143,29 +153,39 @@ func (h *FrontendHTTPHandler) AuthAndLookup(req *http.Request) (*jwt.Token, stri
 	token, hostKey, err := h.FrontendHandler.auth(req)
 	if err == nil {
 		return token, hostKey, nil
+	} else if _, ok := err.(remoteBackendError); ok {
+		return token, hostKey, err
 	}
 
 	tokenString, err := h.TokenLookup.Lookup(req)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Error looking up token.")
-		return nil, "", err
+		return nil, "", authError{authTokenLookup, err}
 	}
 
 	token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return h.parsedPublicKey, nil
 	})
 	if err != nil {
-		return nil, "", err
+		return nil, "", authError{authInvalidToken, err}
 	} else if !token.Valid {
 		return nil, "", noAuthError{err: "Token is not valid"}
 	}
+	if _, err := h.cluster.peer(req, unsignedBody); err != nil {
+		return nil, "", authError{authPeerSignature, err}
+	}
 
 	hostUUID, found := token.Claims["hostUuid"]
 	if found {
-		if hostKey, ok := hostUUID.(string); ok && h.backend.hasBackend(hostKey) {
-			return token, hostKey, nil
+		if hostKey, ok := hostUUID.(string); ok {
+			if h.backend.hasBackend(hostKey) {
+				return token, hostKey, nil
+			}
+			if peer, ok := h.cluster.owner(req, hostKey); ok {
+				return token, hostKey, remoteBackendError{hostKey: hostKey, peer: peer}
+			}
 		}
 	}
 	log.WithFields(log.Fields{"hostUuid": hostUUID}).Infof("Invalid backend host requested.")
-	return nil, "", errors.New("invalid backend")
+	return nil, "", authError{authUnknownBackend, errors.New("invalid backend")}
 }
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// portForwardPath is where port-forward streams are opened on the backend, see
+// backend.PortForwardPattern.
+const portForwardPath = "/v1/portforward/%d"
+
+// FrontendPortForwardHandler forwards a websocket to a TCP port on a host through the host's
+// backend. The token names both with its hostUuid and port claims, the URL has no say in where the
+// stream goes. Bytes are passed through as binary messages in both directions.
+type FrontendPortForwardHandler struct {
+	FrontendHandler
+}
+
+func (h *FrontendPortForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	token, hostKey, authErr := h.auth(req)
+	if remote, ok := authErr.(remoteBackendError); ok {
+		h.cluster.forward(rw, req, remote.peer)
+		return
+	} else if authErr != nil {
+		log.Infof("Frontend auth failed: %v", authErr)
+		authFailed(authErr)
+		http.Error(rw, "Failed authentication", 401)
+		return
+	}
+
+	// Numeric claims are decoded from JSON as float64
+	port, ok := token.Claims["port"].(float64)
+	if !ok || port != float64(int(port)) || port <= 0 || port > 65535 {
+		log.Infof("Port-forward token for host %v has an invalid port: %v", hostKey, token.Claims["port"])
+		http.Error(rw, "Invalid port", 400)
+		return
+	}
+
+	h.serve(rw, req, hostKey, fmt.Sprintf(portForwardPath, int(port)), true)
+}
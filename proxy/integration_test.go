@@ -2,25 +2,34 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 
 	"github.com/rancher/websocket-proxy/backend"
 	"github.com/rancher/websocket-proxy/common"
+	"github.com/rancher/websocket-proxy/proxy/apiinterceptor/filters"
+	"github.com/rancher/websocket-proxy/proxy/apiinterceptor/model"
 	"github.com/rancher/websocket-proxy/testutils"
 )
 
@@ -32,7 +41,7 @@ func TestMain(m *testing.M) {
 
 	ps := &Starter{
 		BackendPaths:       []string{"/v1/connectbackend"},
-		FrontendPaths:      []string{"/v1/binaryecho", "/v1/echo", "/v1/oneanddone", "/v1/repeat", "/v1/sendafterclose"},
+		FrontendPaths:      []string{"/v1/binaryecho", "/v1/echo", "/v1/flood", "/v1/halfclose", "/v1/missing", "/v1/oneanddone", "/v1/repeat", "/v1/sendafterclose"},
 		StatsPaths:         []string{"/v1/hostStats/project"},
 		CattleWSProxyPaths: []string{"/v1/subscribe", "/v1/wsproxyproto"},
 		CattleProxyPaths:   []string{"/{cattle-proxy:.*}"},
@@ -43,6 +52,8 @@ func TestMain(m *testing.M) {
 	handlers := make(map[string]backend.Handler)
 	handlers["/v1/echo"] = &echoHandler{}
 	handlers["/v1/binaryecho"] = &binaryEchoHandler{}
+	handlers["/v1/flood"] = &floodHandler{}
+	handlers["/v1/halfclose"] = &halfCloseHandler{}
 	handlers["/v1/oneanddone"] = &oneAndDoneHandler{}
 	handlers["/v1/repeat"] = &repeatingHandler{}
 	handlers["/v1/sendafterclose"] = &sendAfterCloseHandler{}
@@ -153,8 +164,39 @@ func TestBackendClosesConnection(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if msgType, msgBytes, err := ws.ReadMessage(); err != io.EOF {
-		t.Fatalf("Expected an EOF error to indicate connection was closed. [%v] [%s] [%v]", msgType, msgBytes, err)
+	if msgType, msgBytes, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("Expected a normal close to indicate connection was closed. [%v] [%s] [%v]", msgType, msgBytes, err)
+	}
+}
+
+func TestFrontendHalfClosesConnection(t *testing.T) {
+	signedToken := testutils.CreateToken("1", privateKey)
+	ws := getClientConnection("ws://localhost:1111/v1/halfclose?token="+signedToken, t)
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "abc" {
+		t.Fatalf("Expected the output sent after the frontend finished writing. Received: [%s] [%v]", msg, err)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("Expected a normal close. Received: %v", err)
+	}
+}
+
+func TestBackendHandlerMissing(t *testing.T) {
+	signedToken := testutils.CreateToken("1", privateKey)
+	ws := getClientConnection("ws://localhost:1111/v1/missing?token="+signedToken, t)
+
+	_, _, err := ws.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != common.CloseNotFound || !strings.HasPrefix(closeErr.Text, "handler missing for path") {
+		t.Fatalf("Expected close code 4404 with a reason. Received: %v", err)
 	}
 }
 
@@ -188,6 +230,1327 @@ func TestBackendSendAfterClose(t *testing.T) {
 	sendAndAssertReply(ws2, strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10), t)
 }
 
+func TestLongCloseReason(t *testing.T) {
+	reason := strings.Repeat("é", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(rw, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		closeConnectionWithReason(ws, common.CloseReason{Code: common.CloseNormal, Reason: reason})
+	}))
+	defer server.Close()
+
+	ws := getClientConnection("ws"+strings.TrimPrefix(server.URL, "http"), t)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != websocket.CloseNormalClosure {
+		t.Fatalf("Expected a normal close, got %v", err)
+	}
+	if closeErr.Text != reason[:maxCloseReasonLength-1] {
+		t.Fatalf("Expected the reason to be cut before the split rune, got %q", closeErr.Text)
+	}
+}
+
+func TestSlowFrontendOnlySlowsItsStream(t *testing.T) {
+	signedToken := testutils.CreateToken("1", privateKey)
+	slow := getClientConnection("ws://localhost:1111/v1/flood?token="+signedToken, t)
+	defer slow.Close()
+
+	// Give the flood handler time to fill its window while nobody reads the slow stream
+	time.Sleep(500 * time.Millisecond)
+
+	ws := getClientConnection("ws://localhost:1111/v1/echo?token="+signedToken, t)
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	sendAndAssertReply(ws, strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10), t)
+
+	slow.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; i < floodMessages; i++ {
+		_, msg, err := slow.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed reading message %v of slow stream: %v", i, err)
+		}
+		if len(msg) != floodMessageSize {
+			t.Fatalf("Unexpected message size %v", len(msg))
+		}
+	}
+}
+
+func TestHelloHandshake(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	server := httptest.NewServer(&BackendHandler{
+		proxyManager:    bpm,
+		parsedPublicKey: testutils.ParseTestPublicKey(),
+	})
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/connectbackend?token=" + testutils.CreateBackendToken("hello", privateKey)
+	go backend.ConnectToProxyWithOptions(url, map[string]backend.Handler{}, backend.Options{
+		AgentVersion: "v0.1.0",
+		Labels:       map[string]string{"zone": "a"},
+	})
+
+	var agent, enabled *common.Handshake
+	for i := 0; i < 100 && enabled == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if m, err := bpm.get("hello"); err == nil {
+			m.helloMu.Lock()
+			agent, enabled = m.agent, m.enabled
+			m.helloMu.Unlock()
+		}
+	}
+	if enabled == nil {
+		t.Fatal("Backend never completed the hello exchange")
+	}
+	if agent.AgentVersion != "v0.1.0" || agent.Labels["zone"] != "a" {
+		t.Fatalf("Unexpected agent info: %#v", agent)
+	}
+	if !enabled.Supports(common.WindowUpdate) {
+		t.Fatalf("Expected flow control to be enabled: %#v", enabled)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var frontendStats, backendStats, agentStats common.CompressionStats
+	bpm := newTestBackendProxyManager()
+	bpm.compression = &common.Compression{Stats: &backendStats}
+	server := startTestServer(t, bpm, &common.Compression{Stats: &frontendStats}, "compressed",
+		map[string]backend.Handler{"/v1/echo": &echoHandler{}}, backend.Options{CompressionStats: &agentStats})
+	defer server.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/echo?token="+testutils.CreateToken("compressed", privateKey), http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.EnableWriteCompression(true)
+
+	// Small messages are sent as is
+	sendAndAssertReply(ws, "short", t)
+	sendAndAssertReply(ws, strings.Repeat("container log line\n", 500), t)
+
+	for name, stats := range map[string]*common.CompressionStats{"frontend": &frontendStats, "backend": &backendStats, "agent": &agentStats} {
+		counts := stats.Counts()
+		if counts.PayloadIn == 0 || counts.PayloadOut == 0 || counts.Saved() < 5000 {
+			t.Errorf("Expected the %v link to save bytes with compression: %+v", name, counts)
+		}
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	bpm.maxFrameSize = 16 * 1024
+	server := startTestServer(t, bpm, nil, "fragmented",
+		map[string]backend.Handler{"/v1/echo": &echoHandler{}}, backend.Options{MaxFrameSize: 8 * 1024})
+	defer server.Close()
+
+	ws := getClientConnection("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/echo?token="+testutils.CreateToken("fragmented", privateKey), t)
+	defer ws.Close()
+
+	// Larger than the flow control window, so fragments have to be credited as they arrive
+	msg := strings.Repeat("0123456789", 60*1024)
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, reply, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != msg+"-response" {
+		t.Fatalf("Reply of %v bytes wasn't reassembled correctly", len(reply))
+	}
+
+	m, err := bpm.get("fragmented")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled := m.capabilities(); !enabled.Supports(common.Fragment) || enabled.MaxFrameSize != 16*1024 {
+		t.Fatalf("Expected fragmentation to be enabled: %#v", enabled)
+	}
+}
+
+func TestReverseConnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				conn.Write([]byte(strings.ToUpper(string(data))))
+			}()
+		}
+	}()
+
+	bpm := newTestBackendProxyManager()
+	bpm.reverse = &reverseRouter{
+		destinations: map[string]string{"upper": listener.Addr().String()},
+		handlers: map[string]http.Handler{"api": http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(rw, "%v from %v", req.URL.Path, req.Header.Get(BackendKeyHeader))
+		})},
+	}
+	dialer := &backend.Dialer{}
+	server := startTestServer(t, bpm, nil, "reverse", map[string]backend.Handler{}, backend.Options{Dialer: dialer})
+	defer server.Close()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = dialer.Dial("upper"); err != backend.ErrNotConnected && err != backend.ErrReverseUnsupported {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	conn.(interface {
+		CloseWrite() error
+	}).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(reply) != "HELLO" {
+		t.Fatalf("Unexpected reply from TCP destination: %q, %v", reply, err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	resp, err := client.Get("http://api/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/ping from reverse" {
+		t.Fatalf("Unexpected response from handler: %q", body)
+	}
+
+	if _, err := dialer.Dial("missing"); err == nil {
+		t.Fatal("Expected dialing an unknown destination to fail")
+	}
+}
+
+func TestReverseConnectReusedKey(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	server := newTestServer(bpm, nil)
+	defer server.Close()
+
+	// Play the agent by hand to send a ReverseConnect with the key of a frontend's stream
+	dialer := websocket.Dialer{Subprotocols: []string{common.BinaryProtocol}}
+	agent, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/connectbackend?token="+testutils.CreateBackendToken("reuser", privateKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	send := func(message common.Message) {
+		msgType, data, err := common.EncodeMessage(common.BinaryProtocol, message)
+		if err == nil {
+			err = agent.WriteMessage(msgType, data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(messageType common.MessageType) common.Message {
+		agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			msgType, data, err := agent.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message, err := common.DecodeMessage(common.BinaryProtocol, msgType, data); err == nil && message.Type == messageType {
+				return message
+			}
+		}
+	}
+	hello, err := common.NewHello(common.Handshake{Version: common.ProtocolVersion, MessageTypes: common.SupportedMessageTypes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(hello)
+	receive(common.Hello)
+
+	ws := getClientConnection("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/echo?token="+testutils.CreateToken("reuser", privateKey), t)
+	defer ws.Close()
+	msgKey := receive(common.Connect).Key
+
+	send(common.Message{Key: msgKey, Type: common.ReverseConnect, Body: "anywhere"})
+	if reason := common.ParseClose(receive(common.Close)); reason.Code != common.CloseProtocolError {
+		t.Fatalf("Expected the reused key to be refused as a protocol error, got %+v", reason)
+	}
+	m, err := bpm.get("reuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.errorCount() != 1 {
+		t.Fatalf("Expected one protocol error, got %v", m.errorCount())
+	}
+	if s := m.stream(msgKey); s == nil || s.reverse {
+		t.Fatal("Expected the frontend's stream to be left alone")
+	}
+}
+
+func TestReverseConnectTextProtocol(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	server := newTestServer(bpm, nil)
+	defer server.Close()
+
+	// An agent without binary framing can't carry a reverse stream's bytes
+	agent, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/connectbackend?token="+testutils.CreateBackendToken("texter", privateKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	send := func(message common.Message) {
+		msgType, data, err := common.EncodeMessage("", message)
+		if err == nil {
+			err = agent.WriteMessage(msgType, data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(messageType common.MessageType) common.Message {
+		agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			msgType, data, err := agent.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message, err := common.DecodeMessage("", msgType, data); err == nil && message.Type == messageType {
+				return message
+			}
+		}
+	}
+	hello, err := common.NewHello(common.Handshake{Version: common.ProtocolVersion, MessageTypes: common.SupportedMessageTypes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(hello)
+	reply, err := common.ParseHello(receive(common.Hello))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Supports(common.ReverseConnect) {
+		t.Fatalf("Expected ReverseConnect not to be enabled on the text protocol, got %v", reply.MessageTypes)
+	}
+
+	send(common.Message{Key: "reverse", Type: common.ReverseConnect, Body: "anywhere"})
+	if reason := common.ParseClose(receive(common.Close)); reason.Code != common.CloseProtocolError {
+		t.Fatalf("Expected the ReverseConnect to be refused as a protocol error, got %+v", reason)
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	handler := backend.StreamHandlerFunc(func(ctx context.Context, stream *backend.Stream) error {
+		if stream.URL.Query().Get("mode") != "copy" {
+			return fmt.Errorf("unexpected mode in %v", stream.URL)
+		}
+		_, err := io.Copy(stream, stream)
+		return err
+	})
+	server := startTestServer(t, bpm, nil, "stream",
+		map[string]backend.Handler{"/v1/echo": backend.HandleStream(handler)}, backend.Options{})
+	defer server.Close()
+
+	ws := getClientConnectionWithHeaders("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/echo?mode=copy&token="+testutils.CreateToken("stream", privateKey), t,
+		http.Header{wsProto: {wsProtoBinary}})
+	defer ws.Close()
+
+	msg := []byte{0, 1, 2, 254, 255}
+	if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msgType, reply, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != websocket.BinaryMessage || string(reply) != string(msg) {
+		t.Fatalf("Expected binary %v back, got type %v: %v", msg, msgType, reply)
+	}
+
+	failing := getClientConnection("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/echo?token="+testutils.CreateToken("stream", privateKey), t)
+	defer failing.Close()
+	failing.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := failing.ReadMessage(); !websocket.IsCloseError(err, common.CloseInternalError) {
+		t.Fatalf("Expected an internal error close from the failed handler, got %v", err)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	container := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") == "echo" {
+			conn, buf, err := rw.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+			buf.Flush()
+			line, _ := buf.ReadString('\n')
+			buf.WriteString(strings.ToUpper(line))
+			buf.Flush()
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Header().Set("X-Container", "c1")
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(rw, "%v %v %s", req.Method, req.URL.Path, body)
+	})
+	backendServer := startTestServer(t, bpm, nil, "http",
+		map[string]backend.Handler{"/v1/container-proxy/": &backend.HTTPHandler{Handler: container}}, backend.Options{})
+	defer backendServer.Close()
+
+	token := &jwt.Token{Claims: map[string]interface{}{"proxy": map[string]interface{}{"address": "container:80"}}}
+	frontend := &FrontendHTTPHandler{FrontendHandler: FrontendHandler{backend: bpm}}
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/container-proxy{path:.*}", func(rw http.ResponseWriter, req *http.Request) {
+		frontend.ServeRemoteHTTP(token, "http", rw, req)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1/container-proxy/items", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Container") != "c1" || string(body) != "POST /items payload" {
+		t.Fatalf("Unexpected response: %v %v %q", resp.StatusCode, resp.Header, body)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /v1/container-proxy/upgrade HTTP/1.1\r\nHost: container\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello\n")
+	reader := bufio.NewReader(conn)
+	upgrade, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgrade.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the upgrade to be accepted, got %v", upgrade.StatusCode)
+	}
+	if line, err := reader.ReadString('\n'); err != nil || line != "HELLO\n" {
+		t.Fatalf("Unexpected reply on upgraded connection: %q, %v", line, err)
+	}
+}
+
+func TestAgentDrain(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	bpm.gracePeriod = 5 * time.Second
+	server := newTestServer(bpm, nil)
+	defer server.Close()
+
+	client := &backend.Client{
+		URL:      "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/connectbackend?token=" + testutils.CreateBackendToken("draining", privateKey),
+		Handlers: map[string]backend.Handler{"/v1/echo": &echoHandler{}},
+	}
+	stopped := make(chan error)
+	go func() {
+		stopped <- client.Run(context.Background())
+	}()
+	waitForBackend(t, server, bpm, "draining")
+
+	frontendURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/echo?token=" + testutils.CreateToken("draining", privateKey)
+	ws := getClientConnection(frontendURL, t)
+	sendAndAssertReply(ws, "before", t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	drained := make(chan error)
+	go func() {
+		drained <- client.Drain(ctx)
+	}()
+	m, _ := bpm.get("draining")
+	for i := 0; i < 100 && !m.isDraining(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	refused := getClientConnection(frontendURL, t)
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := refused.ReadMessage(); !websocket.IsCloseError(err, common.CloseUnavailable) {
+		t.Fatalf("Expected new streams to be refused while draining, got %v", err)
+	}
+
+	sendAndAssertReply(ws, "during", t)
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	ws.Close()
+
+	if err := <-drained; err != nil {
+		t.Fatalf("Expected drain to finish once the stream closed, got %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("Expected Run to return nil after draining, got %v", err)
+	}
+}
+
+func TestProxyDrain(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	bpm.gracePeriod = 100 * time.Millisecond
+	server := startTestServer(t, bpm, nil, "proxydrain",
+		map[string]backend.Handler{"/v1/echo": &echoHandler{}}, backend.Options{})
+	defer server.Close()
+
+	ws := getClientConnection("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/echo?token="+testutils.CreateToken("proxydrain", privateKey), t)
+	defer ws.Close()
+	sendAndAssertReply(ws, "before", t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := bpm.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "proxy is shutting down" {
+		t.Fatalf("Expected the stream to be closed as going away after the grace period, got %v", err)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	limiter := &backend.Limiter{PerHandler: map[string]int{"/v1/echo": 1}}
+	server := startTestServer(t, bpm, nil, "limited",
+		map[string]backend.Handler{"/v1/echo": &echoHandler{}}, backend.Options{Limiter: limiter})
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/echo?token=" + testutils.CreateToken("limited", privateKey)
+	ws := getClientConnection(url, t)
+	sendAndAssertReply(ws, "first", t)
+
+	refused := getClientConnection(url, t)
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := refused.ReadMessage(); !websocket.IsCloseError(err, common.CloseTooManyRequests) {
+		t.Fatalf("Expected the stream over the limit to be refused, got %v", err)
+	}
+
+	ws.Close()
+	for i := 0; i < 100 && limiter.Stats().Active > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ws = getClientConnection(url, t)
+	defer ws.Close()
+	sendAndAssertReply(ws, "again", t)
+
+	stats := limiter.Stats()
+	if stats.Active != 1 || stats.Rejected != 1 || stats.Handlers["/v1/echo"].Max != 1 || stats.Handlers["/v1/echo"].Rejected != 1 {
+		t.Fatalf("Unexpected limiter stats: %+v", stats)
+	}
+}
+
+func TestProtocolErrorBudget(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	bpm.errorBudget = 2
+	server := httptest.NewServer(&BackendHandler{
+		proxyManager:    bpm,
+		parsedPublicKey: testutils.ParseTestPublicKey(),
+	})
+	defer server.Close()
+
+	ws := getClientConnection("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/connectbackend?token="+testutils.CreateBackendToken("faulty", privateKey), t)
+	defer ws.Close()
+
+	for _, raw := range []string{"garbage", "key||z||unknown type"} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if m, err := bpm.get("faulty"); err == nil && m.errorCount() == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bpm.hasBackend("faulty") {
+		t.Fatal("Expected backend to stay connected within its error budget")
+	}
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("||1||missing key")); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, common.CloseProtocolError) {
+		t.Fatalf("Expected a protocol error close, got %v", err)
+	}
+}
+
+func TestDefaultErrorBudget(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	server := startTestServer(t, bpm, nil, "budgeted", map[string]backend.Handler{}, backend.Options{})
+	defer server.Close()
+	m, err := bpm.get("budgeted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.errorBudget != defaultErrorBudget {
+		t.Fatalf("Expected an unset budget to default to %v, got %v", defaultErrorBudget, m.errorBudget)
+	}
+}
+
+func TestBackendClosesRightAway(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	server := newTestServer(bpm, nil)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/connectbackend?token=" + testutils.CreateBackendToken("fleeting", privateKey)
+	for i := 0; i < 20; i++ {
+		getClientConnection(url, t).Close()
+	}
+	for i := 0; i < 100 && bpm.hasBackend("fleeting"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bpm.hasBackend("fleeting") {
+		t.Fatal("Expected every link that closed to be removed")
+	}
+}
+
+func TestBackendLivenessTimeout(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	bpm.pingInterval = 20 * time.Millisecond
+	bpm.livenessTimeout = 200 * time.Millisecond
+	server := httptest.NewServer(&BackendHandler{
+		proxyManager:    bpm,
+		parsedPublicKey: testutils.ParseTestPublicKey(),
+	})
+	defer server.Close()
+
+	// A backend that never reads never answers pings, like one behind a dead NAT mapping
+	ws := getClientConnection("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/connectbackend?token="+testutils.CreateBackendToken("frozen", privateKey), t)
+	defer ws.Close()
+	for i := 0; i < 100 && !bpm.hasBackend("frozen"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bpm.hasBackend("frozen") {
+		t.Fatal("Backend never connected")
+	}
+
+	for i := 0; i < 200 && bpm.hasBackend("frozen"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bpm.hasBackend("frozen") {
+		t.Fatal("Expected the backend to be removed after missing its pongs")
+	}
+}
+
+func TestBackendRTT(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	bpm.pingInterval = 20 * time.Millisecond
+	bpm.livenessTimeout = time.Second
+	server := startTestServer(t, bpm, nil, "responsive", map[string]backend.Handler{"/v1/echo": &echoHandler{}}, backend.Options{})
+	defer server.Close()
+
+	var rtt time.Duration
+	ok := false
+	for i := 0; i < 100 && !ok; i++ {
+		rtt, ok = bpm.rtt("responsive")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ok || rtt <= 0 || rtt > time.Second {
+		t.Fatalf("Expected a smoothed RTT for the backend, got %v %v", rtt, ok)
+	}
+
+	// Answering pings keeps the backend connected well past the liveness timeout
+	time.Sleep(1500 * time.Millisecond)
+	if !bpm.hasBackend("responsive") {
+		t.Fatal("Expected a backend answering pings to stay connected")
+	}
+	if _, ok := bpm.rtt("unknown"); ok {
+		t.Fatal("Expected no RTT for an unknown backend")
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	// A service on the host that answers with what it read once its client is done writing
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				conn.Write(append([]byte("got "), data...))
+			}()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	bpm := newTestBackendProxyManager()
+	handlers := map[string]backend.Handler{
+		backend.PortForwardPattern: backend.HandleStream(&backend.PortForwardHandler{Ports: []int{port}}),
+	}
+	server := startTestServer(t, bpm, nil, "forwarder", handlers, backend.Options{})
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/portforward?token="
+	token := testutils.CreateTokenWithPayload(map[string]interface{}{"hostUuid": "forwarder", "port": port}, privateKey)
+	ws := getClientConnection(url+token, t)
+	defer ws.Close()
+	if ws.Subprotocol() != wsProtoBinary {
+		t.Fatalf("Expected the upgrade to advertise binary messages, got %q", ws.Subprotocol())
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte("ping\x00")); err != nil {
+		t.Fatal(err)
+	}
+	// Half-close so the service sees EOF, its answer still comes back
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msgType, msg, err := ws.ReadMessage()
+	if err != nil || msgType != websocket.BinaryMessage || string(msg) != "got ping\x00" {
+		t.Fatalf("Expected the service's binary answer, got %v %q %v", msgType, msg, err)
+	}
+
+	// Ports that aren't allowed are refused by the agent
+	token = testutils.CreateTokenWithPayload(map[string]interface{}{"hostUuid": "forwarder", "port": port + 1}, privateKey)
+	refused := getClientConnection(url+token, t)
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := refused.ReadMessage(); !websocket.IsCloseError(err, common.CloseForbidden) {
+		t.Fatalf("Expected the port to be refused, got %v", err)
+	}
+
+	// Tokens without a port are rejected by the proxy
+	if _, resp, err := websocket.DefaultDialer.Dial(url+testutils.CreateToken("forwarder", privateKey), nil); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a token without a port to be rejected, got %v", err)
+	}
+}
+
+func TestMultipleBackendLinks(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	bpm.gracePeriod = time.Minute
+	bpm.maxLinks = 2
+	handlers := map[string]backend.Handler{"/v1/echo": &echoHandler{}}
+	server := startTestServer(t, bpm, nil, "parallel", handlers, backend.Options{})
+	defer server.Close()
+	backendURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/connectbackend?token=" + testutils.CreateBackendToken("parallel", privateKey)
+	connectLink := func(expected int) []*multiplexer {
+		go backend.ConnectToProxyWithOptions(backendURL, handlers, backend.Options{})
+		for i := 0; i < 100; i++ {
+			bpm.mu.RLock()
+			links := append([]*multiplexer(nil), bpm.multiplexers["parallel"]...)
+			bpm.mu.RUnlock()
+			if len(links) == expected && links[expected-1].capabilities() != nil {
+				return links
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Backend never had %v links", expected)
+		return nil
+	}
+	links := connectLink(2)
+
+	// Streams are spread across the links
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/echo?token=" + testutils.CreateToken("parallel", privateKey)
+	frontends := []*websocket.Conn{getClientConnection(url, t), getClientConnection(url, t)}
+	for _, ws := range frontends {
+		defer ws.Close()
+		sendAndAssertReply(ws, "hi", t)
+	}
+	if links[0].streamCount() != 1 || links[1].streamCount() != 1 {
+		t.Fatalf("Expected one stream per link, got %v and %v", links[0].streamCount(), links[1].streamCount())
+	}
+
+	// Losing a link only ends the streams on it
+	links[0].ws.Close()
+	working := 0
+	for _, ws := range frontends {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := ws.WriteMessage(websocket.TextMessage, []byte("again")); err != nil {
+			continue
+		}
+		if _, reply, err := ws.ReadMessage(); err == nil && string(reply) == "again-response" {
+			working++
+		}
+	}
+	if working != 1 {
+		t.Fatalf("Expected the stream on the remaining link to keep working, %v did", working)
+	}
+	if !bpm.hasBackend("parallel") {
+		t.Fatal("Expected the backend to stay connected over its remaining link")
+	}
+
+	// Going over the limit drains the oldest link
+	connectLink(2)
+	links = connectLink(3)
+	if !links[0].isDraining() || links[1].isDraining() || links[2].isDraining() {
+		t.Fatal("Expected only the oldest link to be draining")
+	}
+}
+
+func TestResumeAfterReconnect(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	bpm.gracePeriod = time.Minute
+	bpm.resumeGrace = 10 * time.Second
+	bpm.replayBufferSize = common.DefaultReplayBufferSize
+	server := newTestServer(bpm, nil)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &backend.Client{
+		URL:        "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/connectbackend?token=" + testutils.CreateBackendToken("resumable", privateKey),
+		Handlers:   map[string]backend.Handler{"/v1/echo": &echoHandler{}},
+		Options:    backend.Options{ResumeGracePeriod: 10 * time.Second},
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}
+	go client.Run(ctx)
+	waitForBackend(t, server, bpm, "resumable")
+	first, _ := bpm.get("resumable")
+
+	ws := getClientConnection("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/echo?token="+testutils.CreateToken("resumable", privateKey), t)
+	defer ws.Close()
+	sendAndAssertReply(ws, "hi", t)
+
+	// Cut the link with responses in flight, and keep sending while it is down
+	for i := 0; i < 10; i++ {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("before-%v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first.ws.Close()
+	for i := 0; i < 10; i++ {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("after-%v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every reply arrives once and in order on the same frontend connection
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for _, prefix := range []string{"before", "after"} {
+		for i := 0; i < 10; i++ {
+			_, reply, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("Stream wasn't resumed: %v", err)
+			}
+			if expected := fmt.Sprintf("%v-%v-response", prefix, i); string(reply) != expected {
+				t.Fatalf("Expected %q, got %q", expected, reply)
+			}
+		}
+	}
+	if m, err := bpm.get("resumable"); err != nil || m == first {
+		t.Fatal("Expected the stream to have moved to a new link")
+	}
+	sendAndAssertReply(ws, "still there", t)
+}
+
+func TestClusterForwarding(t *testing.T) {
+	// Two replicas that know each other, the backend attaches to the first
+	var replicas [2]*httptest.Server
+	var bpms [2]*backendProxyManager
+	var clusters [2]*cluster
+	var routers [2]*http.ServeMux
+	for i := range replicas {
+		bpms[i] = newTestBackendProxyManager()
+		clusters[i] = &cluster{secret: []byte("shared secret")}
+		routers[i] = newTestRouter(bpms[i], nil, clusters[i])
+		replicas[i] = httptest.NewServer(routers[i])
+		defer replicas[i].Close()
+	}
+	for i, c := range clusters {
+		c.address = replicas[i].URL
+		registry := newPeerRegistry(c, []string{replicas[1-i].URL, replicas[i].URL})
+		defer registry.stop()
+		routers[i].Handle(clusterBackendsPath, registry)
+		c.registry = registry
+		bpms[i].registry = registry
+	}
+	go backend.ConnectToProxy("ws"+strings.TrimPrefix(replicas[0].URL, "http")+"/v1/connectbackend?token="+testutils.CreateBackendToken("clustered", privateKey), map[string]backend.Handler{"/v1/echo": &echoHandler{}, "/v1/hostStats": &statsHandler{7}})
+	waitForBackend(t, replicas[0], bpms[0], "clustered")
+	for i := 0; i < 100; i++ {
+		if _, ok := clusters[1].registry.owner("clustered"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if peer, ok := clusters[1].registry.owner("clustered"); !ok || peer != replicas[0].URL {
+		t.Fatalf("Expected the second replica to learn the backend is on %v, got %q", replicas[0].URL, peer)
+	}
+
+	// A frontend on the second replica is forwarded to the first
+	url := "ws" + strings.TrimPrefix(replicas[1].URL, "http") + "/v1/echo?token=" + testutils.CreateToken("clustered", privateKey)
+	ws := getClientConnection(url, t)
+	defer ws.Close()
+	sendAndAssertReply(ws, "hi", t)
+
+	// So are the backend's stats
+	stats := getClientConnection("ws"+strings.TrimPrefix(replicas[1].URL, "http")+"/v1/hostStats?token="+testutils.CreateToken("clustered", privateKey), t)
+	defer stats.Close()
+	stats.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, msg, err := stats.ReadMessage(); err != nil || string(msg) != "7" {
+		t.Fatalf("Expected the backend's stats through the second replica, got %q, %v", msg, err)
+	}
+
+	// Requests that pretend to come from a peer are refused
+	headers := http.Header{peerSignatureHeader: {replicas[1].URL + " " + strconv.FormatInt(time.Now().Unix(), 10) + " forged"}}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, headers); err == nil || resp == nil || resp.StatusCode != 401 {
+		t.Fatalf("Expected a forged peer signature to be refused, got %v", err)
+	}
+	announcement := strings.NewReader(`{"address":"http://elsewhere","hostKeys":["clustered"]}`)
+	if resp, err := http.Post(replicas[1].URL+clusterBackendsPath, "application/json", announcement); err != nil || resp.StatusCode != 401 {
+		t.Fatalf("Expected an unsigned announcement to be refused, got %v", err)
+	}
+	// A peer's signature doesn't carry over to another body
+	replayed, err := http.NewRequest("POST", replicas[1].URL+clusterBackendsPath, strings.NewReader(`{"address":"`+replicas[0].URL+`","hostKeys":["clustered","stolen"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters[0].sign(replayed, bodyDigest([]byte(`{"address":"`+replicas[0].URL+`","hostKeys":["clustered"]}`)))
+	if resp, err := http.DefaultClient.Do(replayed); err != nil || resp.StatusCode != 401 {
+		t.Fatalf("Expected an announcement with a replayed signature to be refused, got %v", err)
+	}
+	if _, ok := clusters[1].registry.owner("stolen"); ok {
+		t.Fatal("Expected the replayed announcement to be ignored")
+	}
+
+	// Once the backend is gone from the first replica the second stops forwarding to it
+	m, _ := bpms[0].get("clustered")
+	m.ws.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok := clusters[1].registry.owner("clustered"); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected the second replica to forget the backend")
+}
+
+func TestClusterFileRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/registry.json"
+	first := &fileRegistry{path: path, self: "http://first"}
+	second := &fileRegistry{path: path, self: "http://second"}
+
+	first.attach("host")
+	if owner, ok := second.owner("host"); !ok || owner != "http://first" {
+		t.Fatalf("Expected host to be on the first replica, got %q", owner)
+	}
+	// A replica only removes its own entries
+	second.detach("host")
+	if _, ok := second.owner("host"); !ok {
+		t.Fatal("Expected the first replica's entry to stay")
+	}
+	first.detach("host")
+	if _, ok := second.owner("host"); ok {
+		t.Fatal("Expected host to be gone")
+	}
+
+	// Replicas changing the file at once don't lose each other's entries
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replica := &fileRegistry{path: path, self: fmt.Sprintf("http://replica%v", i)}
+			<-start
+			replica.attach(fmt.Sprintf("host%v", i))
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		if owner, ok := first.owner(fmt.Sprintf("host%v", i)); !ok || owner != fmt.Sprintf("http://replica%v", i) {
+			t.Fatalf("Expected host%v to be on replica%v, got %q", i, i, owner)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	bpm := newTestBackendProxyManager()
+	bpm.gracePeriod = time.Minute
+	server := startTestServer(t, bpm, nil, "administered", map[string]backend.Handler{"/v1/echo": &echoHandler{}}, backend.Options{AgentVersion: "1.2.3"})
+	defer server.Close()
+	admin := httptest.NewServer(newAdminHandler(bpm, "admin secret"))
+	defer admin.Close()
+	request := func(method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, admin.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	ws := getClientConnection("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/echo?token="+testutils.CreateToken("administered", privateKey), t)
+	defer ws.Close()
+	sendAndAssertReply(ws, "hi", t)
+
+	for _, token := range []string{"", "wrong"} {
+		if resp := request("GET", adminBackendsPath, token); resp.StatusCode != 401 {
+			t.Fatalf("Expected token %q to be refused, got %v", token, resp.Status)
+		}
+	}
+
+	resp := request("GET", adminBackendsPath, "admin secret")
+	defer resp.Body.Close()
+	var list struct {
+		Backends []adminBackend `json:"backends"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Backends) != 1 || list.Backends[0].HostKey != "administered" || len(list.Backends[0].Links) != 1 {
+		t.Fatalf("Expected one backend with one link, got %+v", list.Backends)
+	}
+	link := list.Backends[0].Links[0]
+	if link.AgentVersion != "1.2.3" || link.SessionID == "" || len(link.Streams) != 1 {
+		t.Fatalf("Unexpected link %+v", link)
+	}
+	stream := link.Streams[0]
+	if stream.Path != "/v1/echo" || stream.BytesIn != 2 || stream.BytesOut != int64(len("hi-response")) || stream.Remote == "" {
+		t.Fatalf("Unexpected stream %+v", stream)
+	}
+	if resp := request("GET", adminBackendsPath+"/missing", "admin secret"); resp.StatusCode != 404 {
+		t.Fatalf("Expected a missing backend to be not found, got %v", resp.Status)
+	}
+
+	// Closing the stream tells the frontend why
+	if resp := request("DELETE", adminBackendsPath+"/administered/streams/"+stream.Key, "admin secret"); resp.StatusCode != 204 {
+		t.Fatalf("Failed to close stream: %v", resp.Status)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); !strings.Contains(fmt.Sprint(err), adminCloseReason) {
+		t.Fatalf("Expected the frontend to be closed by the administrator, got %v", err)
+	}
+
+	// Disconnecting the backend closes its link
+	if resp := request("DELETE", adminBackendsPath+"/administered", "admin secret"); resp.StatusCode != 204 {
+		t.Fatalf("Failed to disconnect backend: %v", resp.Status)
+	}
+	for i := 0; i < 100 && bpm.hasBackend("administered"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bpm.hasBackend("administered") {
+		t.Fatal("Expected the backend to be disconnected")
+	}
+}
+
+func TestBackendEvents(t *testing.T) {
+	delivered := make(chan backendEvent, 10)
+	attempts := 0
+	hookServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get(model.SignatureHeader) != filters.SignString(body, []byte("hook secret")) {
+			t.Errorf("Webhook request has a bad signature: %q", req.Header.Get(model.SignatureHeader))
+		}
+		// Fail the first attempt to check it is retried
+		if attempts++; attempts == 1 {
+			http.Error(rw, "try again", 503)
+			return
+		}
+		var event backendEvent
+		if err := json.Unmarshal(body, &event); err != nil || event.Type != req.Header.Get(eventHeader) {
+			t.Errorf("Unexpected webhook request %s: %v", body, err)
+		}
+		delivered <- event
+	}))
+	defer hookServer.Close()
+
+	events := newEventBus(&Config{})
+	hook := newWebhook(hookServer.URL, "hook secret", 2)
+	hook.backoff = 10 * time.Millisecond
+	go hook.run()
+	events.webhooks = append(events.webhooks, hook)
+
+	bpm := newTestBackendProxyManager()
+	bpm.events = events
+	admin := httptest.NewServer(newAdminHandler(bpm, "admin secret"))
+	defer admin.Close()
+
+	req, err := http.NewRequest("GET", admin.URL+adminEventsPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer admin secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected server-sent events, got %v", resp.Header.Get("Content-Type"))
+	}
+	sse := bufio.NewReader(resp.Body)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(admin.URL, "http")+adminEventsPath,
+		http.Header{"Authorization": []string{"Bearer admin secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	server := startTestServer(t, bpm, nil, "evented", map[string]backend.Handler{"/v1/echo": &echoHandler{}}, backend.Options{})
+	defer server.Close()
+	if !bpm.disconnect("evented", adminCloseReason) {
+		t.Fatal("Expected the backend to be connected")
+	}
+
+	nextSSE := func() backendEvent {
+		var eventType string
+		var event backendEvent
+		for {
+			line, err := sse.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "event: ") {
+				eventType = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+					t.Fatal(err)
+				}
+			} else if line == "" && eventType != "" {
+				if event.Type != eventType {
+					t.Fatalf("Event type %v doesn't match its data %+v", eventType, event)
+				}
+				return event
+			}
+		}
+	}
+	nextWebsocket := func() backendEvent {
+		var event backendEvent
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := ws.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	nextWebhook := func() backendEvent {
+		select {
+		case event := <-delivered:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook never received the event")
+		}
+		return backendEvent{}
+	}
+
+	for name, next := range map[string]func() backendEvent{"sse": nextSSE, "websocket": nextWebsocket, "webhook": nextWebhook} {
+		connected, disconnected := next(), next()
+		if connected.Type != backendConnected || connected.HostKey != "evented" || connected.SessionID == "" || connected.RemoteAddr == "" {
+			t.Fatalf("Unexpected %v connected event %+v", name, connected)
+		}
+		if disconnected.Type != backendDisconnected || disconnected.SessionID != connected.SessionID || disconnected.Reason != adminCloseReason {
+			t.Fatalf("Unexpected %v disconnected event %+v", name, disconnected)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/v1/logs/":        streamLogs,
+		"/v1/exec":         streamExec,
+		"/v1/stats/abc":    streamStats,
+		"/v1/dockersocket": streamDockerSocket,
+		"/v1/echo":         streamOther,
+		"/":                streamOther,
+	} {
+		if actual := frontendStreamType(path); actual != expected {
+			t.Fatalf("Expected %v to be a %v stream, got %v", path, expected, actual)
+		}
+	}
+
+	streams := histogramCount(t, streamDurationMetric.WithLabelValues(streamOther))
+	noToken := counterValue(t, authFailuresMetric.WithLabelValues(authNoToken))
+	sent := counterValue(t, messagesMetric.WithLabelValues(directionToBackend))
+
+	ws := getClientConnection("ws://localhost:1111/v1/echo?token="+testutils.CreateToken("1", privateKey), t)
+	sendAndAssertReply(ws, "metered", t)
+	ws.Close()
+	for i := 0; i < 100 && histogramCount(t, streamDurationMetric.WithLabelValues(streamOther)) == streams; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if histogramCount(t, streamDurationMetric.WithLabelValues(streamOther)) == streams {
+		t.Fatal("Expected the stream's duration to be observed")
+	}
+	if counterValue(t, messagesMetric.WithLabelValues(directionToBackend)) <= sent {
+		t.Fatal("Expected messages sent to the backend to be counted")
+	}
+
+	if resp, err := http.Get("http://localhost:1111/v1/echo"); err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode != 401 {
+		t.Fatalf("Expected a request without a token to be refused, got %v", resp.Status)
+	}
+	if counterValue(t, authFailuresMetric.WithLabelValues(authNoToken)) != noToken+1 {
+		t.Fatal("Expected the request without a token to be counted")
+	}
+
+	// Metrics are only served on the admin listener, to admins
+	admin := httptest.NewServer(newAdminHandler(newTestBackendProxyManager(), "admin secret"))
+	defer admin.Close()
+	public, err := http.Get("http://localhost:1111" + adminMetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(public.Body)
+	public.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "websocket_proxy_") {
+		t.Fatal("Expected the public listener not to serve metrics")
+	}
+	if resp, err := http.Get(admin.URL + adminMetricsPath); err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode != 401 {
+		t.Fatalf("Expected metrics to require the admin token, got %v", resp.Status)
+	}
+	req, err := http.NewRequest("GET", admin.URL+adminMetricsPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer admin secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	for _, expected := range []string{
+		"# TYPE websocket_proxy_backends gauge\n",
+		"\nwebsocket_proxy_backends ",
+		`websocket_proxy_auth_failures_total{reason="no_token"} `,
+		`websocket_proxy_stream_duration_seconds_count{type="other"} `,
+		`websocket_proxy_streams{type="other"} `,
+		`websocket_proxy_backend_bytes_total{direction="from_backend"} `,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected the metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func histogramCount(t *testing.T, histogram prometheus.Histogram) uint64 {
+	var m dto.Metric
+	if err := histogram.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// newTestBackendProxyManager returns a backend proxy manager with the defaults the proxy is started
+// with, for tests to change what they exercise.
+func newTestBackendProxyManager() *backendProxyManager {
+	return &backendProxyManager{
+		multiplexers:   make(map[string][]*multiplexer),
+		mu:             &sync.RWMutex{},
+		windowSize:     common.DefaultWindowSize,
+		maxFrameSize:   common.DefaultMaxFrameSize,
+		maxMessageSize: common.DefaultMaxMessageSize,
+	}
+}
+
+// startTestServer serves a backend link and /v1/echo frontends for bpm, then connects a backend
+// with the given key, handlers and options to it.
+func startTestServer(t *testing.T, bpm *backendProxyManager, compression *common.Compression, hostKey string, handlers map[string]backend.Handler, opts backend.Options) *httptest.Server {
+	server := newTestServer(bpm, compression)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/connectbackend?token=" + testutils.CreateBackendToken(hostKey, privateKey)
+	go backend.ConnectToProxyWithOptions(url, handlers, opts)
+	waitForBackend(t, server, bpm, hostKey)
+	return server
+}
+
+func newTestServer(bpm *backendProxyManager, compression *common.Compression) *httptest.Server {
+	return httptest.NewServer(newTestRouter(bpm, compression, nil))
+}
+
+func newTestRouter(bpm *backendProxyManager, compression *common.Compression, c *cluster) *http.ServeMux {
+	router := http.NewServeMux()
+	router.Handle("/v1/connectbackend", &BackendHandler{
+		proxyManager:    bpm,
+		parsedPublicKey: testutils.ParseTestPublicKey(),
+		compression:     bpm.compression,
+	})
+	router.Handle("/v1/echo", &FrontendHandler{
+		backend:         bpm,
+		parsedPublicKey: testutils.ParseTestPublicKey(),
+		compression:     compression,
+		cluster:         c,
+	})
+	router.Handle("/v1/portforward", &FrontendPortForwardHandler{
+		FrontendHandler: FrontendHandler{
+			backend:         bpm,
+			parsedPublicKey: testutils.ParseTestPublicKey(),
+			compression:     compression,
+			cluster:         c,
+		},
+	})
+	router.Handle("/v1/hostStats", &StatsHandler{
+		backend:         bpm,
+		parsedPublicKey: testutils.ParseTestPublicKey(),
+		compression:     compression,
+		cluster:         c,
+	})
+	return router
+}
+
+func waitForBackend(t *testing.T, server *httptest.Server, bpm *backendProxyManager, hostKey string) {
+	for i := 0; i < 100; i++ {
+		if m, err := bpm.get(hostKey); err == nil && m.capabilities() != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Close()
+	t.Fatalf("Backend %v never connected", hostKey)
+}
+
 func TestMultiHostStats(t *testing.T) {
 	payload := map[string]interface{}{
 		"project": []map[string]string{
@@ -313,6 +1676,27 @@ func sendAndAssertReplyWithType(ws *websocket.Conn, msg string, msgType int, t *
 	}
 }
 
+// halfCloseHandler replies with everything it received once the frontend is done sending.
+type halfCloseHandler struct {
+}
+
+func (h *halfCloseHandler) SupportsHalfClose() bool {
+	return true
+}
+
+func (h *halfCloseHandler) Handle(key string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message) {
+	defer backend.SignalHandlerClosed(key, response)
+	received := ""
+	for m := range incomingMessages {
+		received += m
+	}
+	response <- common.Message{
+		Key:  key,
+		Type: common.Body,
+		Body: received,
+	}
+}
+
 type sendAfterCloseHandler struct {
 }
 
@@ -330,6 +1714,26 @@ func (e *sendAfterCloseHandler) Handle(key string, initialMessage string, incomi
 	}
 }
 
+const (
+	floodMessages    = 100
+	floodMessageSize = 10 * 1024
+)
+
+type floodHandler struct {
+}
+
+func (h *floodHandler) Handle(key string, initialMessage string, incomingMessages <-chan string, response chan<- common.Message) {
+	defer backend.SignalHandlerClosed(key, response)
+	data := strings.Repeat("x", floodMessageSize)
+	for i := 0; i < floodMessages; i++ {
+		response <- common.Message{
+			Key:  key,
+			Type: common.Body,
+			Body: data,
+		}
+	}
+}
+
 type statsHandler struct {
 	i int
 }
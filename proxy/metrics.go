@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics served on the admin listener, see AdminHandler.
+var (
+	backendsMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "websocket_proxy_backends",
+		Help: "Backends with at least one link to this proxy.",
+	})
+	backendLinksMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "websocket_proxy_backend_links",
+		Help: "Websocket links from backends to this proxy.",
+	})
+	streamsMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_proxy_streams",
+		Help: "Frontend streams and requests being served, by type.",
+	}, []string{"type"})
+	streamDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "websocket_proxy_stream_duration_seconds",
+		Help:    "How long frontend streams and requests lasted, by type.",
+		Buckets: []float64{.01, .1, 1, 10, 60, 300, 1800, 3600, 14400},
+	}, []string{"type"})
+	messagesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_proxy_backend_messages_total",
+		Help: "Messages exchanged with backends, by direction.",
+	}, []string{"direction"})
+	bytesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_proxy_backend_bytes_total",
+		Help: "Bytes of messages exchanged with backends before compression, by direction.",
+	}, []string{"direction"})
+	frontendTimeoutsMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "websocket_proxy_frontend_send_timeouts_total",
+		Help: "Messages from backends dropped because a frontend didn't take them in time.",
+	})
+	authFailuresMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_proxy_auth_failures_total",
+		Help: "Requests refused for failing authentication, by reason.",
+	}, []string{"reason"})
+	tokenLookupsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_proxy_token_lookups_total",
+		Help: "Token lookups for cookie authenticated requests, by whether the cache had the token.",
+	}, []string{"result"})
+	httpPipeLatencyMetric = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "websocket_proxy_http_pipe_latency_seconds",
+		Help: "Time from opening an HTTP pipe to a backend to receiving its response headers.",
+	})
+	webhookDeliveriesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_proxy_event_webhook_deliveries_total",
+		Help: "Backend events sent to webhooks, by whether they were delivered, failed after every retry or dropped.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		backendsMetric,
+		backendLinksMetric,
+		streamsMetric,
+		streamDurationMetric,
+		messagesMetric,
+		bytesMetric,
+		frontendTimeoutsMetric,
+		authFailuresMetric,
+		tokenLookupsMetric,
+		httpPipeLatencyMetric,
+		webhookDeliveriesMetric,
+	)
+}
+
+const (
+	directionToBackend   = "to_backend"
+	directionFromBackend = "from_backend"
+)
+
+// Stream types of frontend requests.
+const (
+	streamLogs           = "logs"
+	streamExec           = "exec"
+	streamConsole        = "console"
+	streamDockerSocket   = "dockersocket"
+	streamStats          = "stats"
+	streamContainerProxy = "container-proxy"
+	streamPortForward    = "portforward"
+	streamK8s            = "k8s"
+	streamCattle         = "cattle"
+	streamOther          = "other"
+)
+
+// Reasons authentication failures are counted under.
+const (
+	authNoToken        = "no_token"
+	authInvalidToken   = "invalid_token"
+	authUnknownBackend = "unknown_backend"
+	authTokenLookup    = "token_lookup"
+	authPeerSignature  = "peer_signature"
+	authBackendToken   = "backend_token"
+	authAdminToken     = "admin_token"
+	authOther          = "other"
+)
+
+// authError is a failed authentication, with the reason it is counted under.
+type authError struct {
+	reason string
+	err    error
+}
+
+func (e authError) Error() string {
+	return e.err.Error()
+}
+
+// authFailed counts a request refused because authentication failed with err.
+func authFailed(err error) {
+	reason := authOther
+	switch e := err.(type) {
+	case noAuthError:
+		reason = authNoToken
+	case authError:
+		reason = e.reason
+	}
+	authFailuresMetric.WithLabelValues(reason).Inc()
+}
+
+// frontendStreamType is the type of stream a request to one of the FrontendPaths opens, from the
+// first part of its path after the version.
+func frontendStreamType(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(parts) < 2 {
+		return streamOther
+	}
+	switch strings.ToLower(parts[1]) {
+	case streamLogs:
+		return streamLogs
+	case streamExec:
+		return streamExec
+	case streamConsole:
+		return streamConsole
+	case streamDockerSocket:
+		return streamDockerSocket
+	case streamStats:
+		return streamStats
+	}
+	return streamOther
+}
+
+// countStreams counts the requests h serves as streams of the type returned by streamType.
+func countStreams(h http.Handler, streamType func(req *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t := streamType(req)
+		start := time.Now()
+		streamsMetric.WithLabelValues(t).Inc()
+		defer func() {
+			streamsMetric.WithLabelValues(t).Dec()
+			streamDurationMetric.WithLabelValues(t).Observe(time.Since(start).Seconds())
+		}()
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// streamsOf is a streamType for handlers that only serve one type of stream.
+func streamsOf(t string) func(req *http.Request) string {
+	return func(*http.Request) string {
+		return t
+	}
+}
@@ -1,7 +1,11 @@
 package proxy
 
 import (
+	"fmt"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -12,33 +16,152 @@ import (
 )
 
 type multiplexer struct {
-	backendSessionID  string
-	backendKey        string
-	messagesToBackend chan string
-	frontendChans     map[string]chan<- common.Message
-	proxyManager      proxyManager
-	frontendMu        *sync.RWMutex
+	backendSessionID string
+	backendKey       string
+	protocol         string
+	windowSize       int
+	maxFrameSize     int
+	maxMessageSize   int
+	fragmenter       common.Fragmenter
+	compression      *common.Compression
+	reverse          *reverseRouter
+	errorBudget      int
+	protocolErrors   int32
+	gracePeriod      time.Duration
+	pingInterval     time.Duration
+	livenessTimeout  time.Duration
+	resumeGrace      time.Duration
+	replayBufferSize int
+	rtt              int64
+	lastSeen         int64
+	remoteAddr       string
+	connected        time.Time
+	ws               *websocket.Conn
+	draining         chan struct{}
+	drainOnce        sync.Once
+	drainReason      string
+	scheduler        *common.Scheduler
+	streams          map[string]*stream
+	proxyManager     proxyManager
+	streamsMu        *sync.RWMutex
+	helloMu          *sync.Mutex
+	// agent is what the backend described in its hello and enabled is what the proxy enabled in
+	// reply. Both are nil for backends that predate the handshake.
+	agent   *common.Handshake
+	enabled *common.Handshake
 }
 
-func (m *multiplexer) initializeClient() (string, <-chan common.Message) {
+// initializeClient opens a stream for a frontend connecting from remote.
+func (m *multiplexer) initializeClient(remote string) (string, <-chan common.Message) {
 	msgKey := uuid.New()
-	frontendChan := make(chan common.Message)
-	m.frontendMu.Lock()
-	defer m.frontendMu.Unlock()
-	m.frontendChans[msgKey] = frontendChan
-	return msgKey, frontendChan
+	s := newStream(msgKey, m.windowSize)
+	s.strict = m.protocol == common.BinaryProtocol
+	s.remote = remote
+	s.out = m
+	if m.resumable() {
+		s.replay = common.NewReplayBuffer(m.replayBufferSize)
+	}
+	m.streamsMu.Lock()
+	m.streams[msgKey] = s
+	m.streamsMu.Unlock()
+
+	go s.deliver(s.grant)
+	return msgKey, s.frontend
+}
+
+// drain stops new streams to the backend and closes the link once the open streams have finished,
+// or after the grace period. If notify is set the backend is told with a GoingAway.
+func (m *multiplexer) drain(reason string, notify bool) {
+	m.drainOnce.Do(func() {
+		log.Infof("Draining backend %v - %v: %v. Open streams: %v.", m.backendKey, m.backendSessionID, reason, m.streamCount())
+		m.drainReason = reason
+		close(m.draining)
+		if notify && m.capabilities().Supports(common.GoingAway) {
+			m.scheduler.Push(common.NewGoingAway(reason))
+		}
+
+		go func() {
+			deadline := time.NewTimer(m.gracePeriod)
+			defer deadline.Stop()
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			for m.streamCount() > 0 {
+				select {
+				case <-deadline.C:
+					log.Infof("Closing %v streams still open on backend %v after %v.", m.streamCount(), m.backendKey, m.gracePeriod)
+					m.ws.Close()
+					return
+				case <-ticker.C:
+				}
+			}
+			m.ws.Close()
+		}()
+	})
+}
+
+func (m *multiplexer) isDraining() bool {
+	select {
+	case <-m.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *multiplexer) streamCount() int {
+	m.streamsMu.RLock()
+	defer m.streamsMu.RUnlock()
+	return len(m.streams)
+}
+
+func (m *multiplexer) stream(msgKey string) *stream {
+	m.streamsMu.RLock()
+	defer m.streamsMu.RUnlock()
+	return m.streams[msgKey]
 }
 
 func (m *multiplexer) connect(msgKey, url string) {
-	m.messagesToBackend <- common.FormatMessage(msgKey, common.Connect, url)
+	if s := m.stream(msgKey); s != nil {
+		s.setURL(url)
+	}
+	m.scheduler.Push(common.Message{Key: msgKey, Type: common.Connect, Body: url})
+}
+
+func (m *multiplexer) send(msgKey, msg string, binary bool) {
+	message := common.Message{Key: msgKey, Type: common.Body, Body: msg, Binary: binary}
+	if s := m.stream(msgKey); s != nil {
+		s.send(message)
+		return
+	}
+	m.push(nil, message)
 }
 
-func (m *multiplexer) send(msgKey, msg string) {
-	m.messagesToBackend <- common.FormatMessage(msgKey, common.Body, msg)
+// push fragments a message for the backend and queues it, waiting for credit on the stream's
+// window if s is set. It returns false if the stream was closed first.
+func (m *multiplexer) push(s *stream, message common.Message) bool {
+	for _, message := range m.fragmenter.Split(message) {
+		body := message.Type == common.Body || message.Type == common.Fragment
+		if s != nil && body && !s.sendWindow.Acquire(len(message.Body)) {
+			return false
+		}
+		m.scheduler.Push(message)
+	}
+	return true
 }
 
 func (m *multiplexer) sendClose(msgKey string) {
-	m.messagesToBackend <- common.FormatMessage(msgKey, common.Close, "")
+	m.scheduler.Push(common.Message{Key: msgKey, Type: common.Close})
+}
+
+// abort closes a stream whose backend broke the protocol, telling both sides why.
+func (m *multiplexer) abort(s *stream, reason string) {
+	m.streamsMu.Lock()
+	delete(m.streams, s.key)
+	m.streamsMu.Unlock()
+
+	closeMessage := common.NewClose(s.key, common.CloseProtocolError, reason)
+	s.closeWith(closeMessage)
+	m.scheduler.Push(closeMessage)
 }
 
 func (m *multiplexer) closeConnection(msgKey string, notifyBackend bool) {
@@ -46,86 +169,365 @@ func (m *multiplexer) closeConnection(msgKey string, notifyBackend bool) {
 		m.sendClose(msgKey)
 	}
 
-	m.frontendMu.Lock()
-	defer m.frontendMu.Unlock()
-	if frontendChan, ok := m.frontendChans[msgKey]; ok {
-		close(frontendChan)
-		delete(m.frontendChans, msgKey)
+	m.streamsMu.Lock()
+	defer m.streamsMu.Unlock()
+	if s, ok := m.streams[msgKey]; ok {
+		s.close()
+		delete(m.streams, msgKey)
+	}
+	m.scheduler.Forget(msgKey)
+}
+
+func (m *multiplexer) windowUpdate(s *stream, message common.Message) error {
+	n, err := common.ParseWindowUpdate(message)
+	if err != nil {
+		return err
+	}
+	if s.sendWindow.Grant(n) && !s.reverse {
+		// The backend does flow control for this stream, so grant it the window for its responses
+		m.scheduler.Push(common.NewWindowUpdate(s.key, s.recvWindow.Size()))
+	}
+	return nil
+}
+
+// violation counts a message from the backend that broke the protocol. A backend that breaks it
+// more often than its error budget allows is disconnected; a negative budget never disconnects.
+func (m *multiplexer) violation(ws *websocket.Conn, err error) {
+	count := int(atomic.AddInt32(&m.protocolErrors, 1))
+	log.Warnf("Protocol error %v from backend %v: %v", count, m.backendKey, err)
+	if m.errorBudget < 0 || count <= m.errorBudget {
+		return
 	}
+
+	log.Errorf("Disconnecting backend %v - %v after %v protocol errors.", m.backendKey, m.backendSessionID, count)
+	ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(common.CloseProtocolError, "protocol error budget exceeded"),
+		time.Now().Add(time.Second))
+	ws.Close()
+}
+
+// errorCount returns the number of protocol errors the backend has made.
+func (m *multiplexer) errorCount() int {
+	return int(atomic.LoadInt32(&m.protocolErrors))
+}
+
+// hello answers the backend's hello. It returns true if the backend reassembles fragments, in which
+// case it also has to respect the proxy's max frame size.
+func (m *multiplexer) hello(message common.Message) (bool, error) {
+	agent, err := common.ParseHello(message)
+	if err != nil {
+		return false, err
+	}
+
+	enabled := common.Handshake{
+		Version:      common.ProtocolVersion,
+		MessageTypes: common.CommonMessageTypes(agent),
+		MaxFrameSize: m.maxFrameSize,
+	}
+	if m.resumeGrace <= 0 {
+		// Streams aren't kept when the backend disconnects, don't let it expect otherwise
+		enabled.MessageTypes = common.WithoutMessageType(enabled.MessageTypes, common.Resume)
+	}
+	if m.protocol != common.BinaryProtocol {
+		// Reverse streams carry raw bytes, which text frames can't hold
+		enabled.MessageTypes = common.WithoutMessageType(enabled.MessageTypes, common.ReverseConnect)
+	}
+	reply, err := common.NewHello(enabled)
+	if err != nil {
+		log.Errorf("Failed to build hello for backend %v: %v", m.backendKey, err)
+		return false, nil
+	}
+
+	m.helloMu.Lock()
+	m.agent = &agent
+	m.enabled = &enabled
+	m.helloMu.Unlock()
+
+	log.Infof("Backend %v with session ID %v sent hello. Protocol version: %v, agent version: %q, labels: %v, max frame size: %v. Enabled message types: %v.",
+		m.backendKey, m.backendSessionID, agent.Version, agent.AgentVersion, agent.Labels, agent.MaxFrameSize, enabled.MessageTypes)
+	m.scheduler.Push(reply)
+
+	fragments := enabled.Supports(common.Fragment) && m.protocol == common.BinaryProtocol
+	if fragments {
+		m.fragmenter.SetSize(agent.MaxFrameSize)
+	}
+	return fragments, nil
+}
+
+// capabilities returns what was enabled for the link in the hello exchange, or nil if the backend
+// didn't send a hello.
+func (m *multiplexer) capabilities() *common.Handshake {
+	m.helloMu.Lock()
+	defer m.helloMu.Unlock()
+	return m.enabled
+}
+
+// ping sends the time in the ping's payload so that the pong, which echoes it, gives the round
+// trip time.
+func (m *multiplexer) ping(ws *websocket.Conn) {
+	ws.WriteControl(websocket.PingMessage, []byte(strconv.FormatInt(time.Now().UnixNano(), 10)), time.Now().Add(time.Second))
+}
+
+// pong keeps the link alive and folds the round trip into the smoothed RTT, weighting each sample
+// by 1/8 as TCP does. Pongs are handled on the reader goroutine, which is the only one writing rtt.
+func (m *multiplexer) pong(ws *websocket.Conn, data string) error {
+	m.extendLiveness(ws)
+
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return nil
+	}
+	sample := time.Since(time.Unix(0, sent))
+	if sample < 0 {
+		return nil
+	}
+	rtt := time.Duration(atomic.LoadInt64(&m.rtt))
+	if rtt == 0 {
+		rtt = sample
+	} else {
+		rtt += (sample - rtt) / 8
+	}
+	atomic.StoreInt64(&m.rtt, int64(rtt))
+	log.Debugf("RTT to backend %v - %v: %v, smoothed %v.", m.backendKey, m.backendSessionID, sample, rtt)
+	return nil
+}
+
+// smoothedRTT returns the backend's smoothed round trip time, or zero before the first pong.
+func (m *multiplexer) smoothedRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.rtt))
+}
+
+// extendLiveness pushes back the read deadline. A backend that sends nothing, not even a pong, for
+// the liveness timeout is considered dead and the read fails.
+func (m *multiplexer) extendLiveness(ws *websocket.Conn) {
+	m.touch()
+	if m.livenessTimeout > 0 {
+		ws.SetReadDeadline(time.Now().Add(m.livenessTimeout))
+	}
+}
+
+// touch records that the backend was heard from.
+func (m *multiplexer) touch() {
+	atomic.StoreInt64(&m.lastSeen, time.Now().UnixNano())
+}
+
+// healthy reports whether the backend has been heard from within two ping intervals. A link whose
+// pongs stopped may be half-open and is only used if the backend has no better one.
+func (m *multiplexer) healthy() bool {
+	lastSeen := time.Unix(0, atomic.LoadInt64(&m.lastSeen))
+	return time.Since(lastSeen) < 2*m.pingInterval
+}
+
+// preferredTo reports whether a new stream should go to m rather than other, see
+// backendProxyManager.get. Links are ordered oldest first so that ties go to the newer one.
+func (m *multiplexer) preferredTo(other *multiplexer) bool {
+	if m.isDraining() != other.isDraining() {
+		return !m.isDraining()
+	}
+	if m.healthy() != other.healthy() {
+		return m.healthy()
+	}
+	return m.streamCount() <= other.streamCount()
 }
 
 func (m *multiplexer) routeMessages(ws *websocket.Conn) {
 	stopSignal := make(chan bool, 1)
+	ws.SetPongHandler(func(data string) error {
+		return m.pong(ws, data)
+	})
 
 	// Read messages from backend
 	go func(stop chan<- bool) {
+		reassembler := common.NewReassembler(m.maxMessageSize)
 		for {
-			msgType, msg, err := ws.ReadMessage()
+			m.extendLiveness(ws)
+			msgType, msg, err := m.compression.ReadMessage(ws)
 			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					log.Warnf("Shutting down backend %v - %v. Nothing received for %v, the connection is presumed dead.",
+						m.backendKey, m.backendSessionID, m.livenessTimeout)
+					m.shutdown(stop, err)
+					ws.Close()
+					return
+				}
 				log.Infof("Shutting down backend %v. Connection closed because: %v.", m.backendKey, err)
-				m.shutdown(stop)
+				m.shutdown(stop, err)
 				return
 			}
+			messagesMetric.WithLabelValues(directionFromBackend).Inc()
+			bytesMetric.WithLabelValues(directionFromBackend).Add(float64(len(msg)))
 
-			if msgType != websocket.TextMessage {
+			message, err := common.DecodeMessage(m.protocol, msgType, msg)
+			if err != nil {
+				m.violation(ws, err)
 				continue
 			}
-			message := common.ParseMessage(string(msg))
 
-			m.frontendMu.RLock()
-			frontendChan, ok := m.frontendChans[message.Key]
-			timedOut := false
-			if ok {
-				select {
-				case frontendChan <- message:
-				case <-time.After(time.Second * 10):
-					timedOut = true
+			if message.Type == common.Hello && message.Key == "" {
+				fragments, err := m.hello(message)
+				if err != nil {
+					m.violation(ws, err)
+				} else if fragments && m.maxFrameSize > 0 {
+					ws.SetReadLimit(common.ReadLimit(m.maxFrameSize))
+					reassembler.LimitFrames(m.maxFrameSize)
 				}
+				continue
 			}
-			m.frontendMu.RUnlock()
 
-			if timedOut {
-				log.Warnf("Timed out sending message with key %v to frontend channel.", message.Key)
-				m.proxyManager.closeConnection(m.backendKey, message.Key)
+			if message.Type == common.GoingAway && message.Key == "" {
+				m.drain("backend is shutting down: "+message.Body, false)
+				continue
+			}
+
+			if message.Type == common.Resume {
+				if err := m.resume(message); err != nil {
+					m.violation(ws, err)
+				}
+				continue
 			}
 
-			if !ok && message.Type != common.Close {
-				log.Infof("Couldn't find frontend channel for key %v. Closing frontend connection.", m.backendKey)
-				m.proxyManager.closeConnection(m.backendKey, message.Key)
+			if message.Type == common.ReverseConnect {
+				if !m.capabilities().Supports(common.ReverseConnect) {
+					m.scheduler.Push(common.NewClose(message.Key, common.CloseProtocolError, "reverse connect is not enabled"))
+					m.violation(ws, fmt.Errorf("ReverseConnect to %q without enabling it", message.Body))
+					continue
+				}
+				if m.isDraining() {
+					m.scheduler.Push(common.NewClose(message.Key, common.CloseUnavailable, m.drainReason))
+					continue
+				}
+				go m.reverseConnect(message)
+				continue
+			}
+
+			s := m.stream(message.Key)
+			if s == nil {
+				reassembler.Forget(message.Key)
+				if message.Type != common.Close && message.Type != common.WindowUpdate {
+					log.Infof("Couldn't find frontend channel for key %v. Closing frontend connection.", m.backendKey)
+					m.closeConnection(message.Key, true)
+				}
+				continue
+			}
+
+			if message.Type == common.WindowUpdate {
+				if err := m.windowUpdate(s, message); err != nil {
+					m.violation(ws, err)
+				}
+				continue
+			}
+
+			credit := 0
+			switch message.Type {
+			case common.Body, common.Fragment:
+				credit = len(message.Body)
+				var complete bool
+				message, complete, err = reassembler.Add(message)
+				if err != nil {
+					m.abort(s, err.Error())
+					m.violation(ws, err)
+					continue
+				}
+				if !complete {
+					// Nothing reaches the frontend until the last piece arrives, so return the
+					// credit for the fragment now or the backend may never send that piece
+					s.credit(credit, func(n int) {
+						m.scheduler.Push(common.NewWindowUpdate(s.key, n))
+					})
+					continue
+				}
+			case common.Close:
+				reassembler.Forget(message.Key)
+			}
+
+			if common.Sequenced(message.Type) {
+				s.countReceived()
+			}
+			if err := s.enqueue(message, credit); err != nil {
+				m.closeConnection(message.Key, true)
+				m.violation(ws, err)
 			}
 		}
 	}(stopSignal)
 
 	// Write messages to backend
 	go func(stop <-chan bool) {
-		ticker := time.NewTicker(time.Second * 5)
+		// Ping right away so that the RTT is known without waiting for the first tick
+		m.ping(ws)
+		ticker := time.NewTicker(m.pingInterval)
 		defer ticker.Stop()
 		for {
-			select {
-			case message, ok := <-m.messagesToBackend:
-				if !ok {
+			message, ok := m.scheduler.Next()
+			if !ok {
+				select {
+				case <-m.scheduler.Ready():
+					continue
+				case <-ticker.C:
+					m.ping(ws)
+					continue
+				case <-stop:
 					return
 				}
-				ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				err := ws.WriteMessage(websocket.TextMessage, []byte(message))
-				if err != nil {
-					log.Errorf("Error writing message to backend %v - %v. Error: %v", m.backendKey, m.backendSessionID, err)
-					ws.Close()
-				}
-			case <-ticker.C:
-				ws.WriteControl(websocket.PingMessage, []byte(""), time.Now().Add(time.Second))
+			}
+
+			msgType, data, err := common.EncodeMessage(m.protocol, message)
+			if err != nil {
+				log.Errorf("Error encoding message for backend %v: %v", m.backendKey, err)
+				continue
+			}
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			err = m.compression.WriteMessage(ws, msgType, data)
+			if err != nil {
+				log.Errorf("Error writing message to backend %v - %v. Error: %v", m.backendKey, m.backendSessionID, err)
+				ws.Close()
+			} else {
+				messagesMetric.WithLabelValues(directionToBackend).Inc()
+				bytesMetric.WithLabelValues(directionToBackend).Add(float64(len(data)))
+			}
 
+			select {
+			case <-ticker.C:
+				m.ping(ws)
 			case <-stop:
 				return
+			default:
 			}
 		}
 	}(stopSignal)
 }
 
-func (m *multiplexer) shutdown(stop chan<- bool) {
-	m.proxyManager.removeBackend(m.backendKey, m.backendSessionID)
+// shutdown cleans up after the link was lost with err. Streams that can be resumed are parked for
+// the backend to pick up when it reconnects, the others are closed.
+func (m *multiplexer) shutdown(stop chan<- bool, err error) {
+	reason := "backend disconnected"
+	if m.isDraining() {
+		reason = m.drainReason
+	}
+	cause := reason
+	if !m.isDraining() && err != nil {
+		cause = err.Error()
+	}
+	m.proxyManager.removeBackend(m.backendKey, m.backendSessionID, cause)
 	stop <- true
-	for key := range m.frontendChans {
-		m.closeConnection(key, false)
+	m.scheduler.Close()
+
+	m.streamsMu.Lock()
+	streams := m.streams
+	m.streams = make(map[string]*stream)
+	m.streamsMu.Unlock()
+
+	resume := m.canResume(err)
+	parked := 0
+	for key, s := range streams {
+		if resume && s.replay != nil {
+			s.park()
+			m.proxyManager.park(m.backendKey, s)
+			parked++
+			continue
+		}
+		s.closeWith(common.NewClose(key, common.CloseGoingAway, reason))
+	}
+	if parked > 0 {
+		log.Infof("Keeping %v streams of backend %v for %v for it to reconnect and resume them.", parked, m.backendKey, m.resumeGrace)
 	}
 }
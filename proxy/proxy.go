@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -17,6 +18,7 @@ import (
 	"github.com/docker/go-connections/tlsconfig"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"github.com/rancher/websocket-proxy/common"
 	"github.com/rancher/websocket-proxy/k8s"
 	"github.com/rancher/websocket-proxy/proxy/apiinterceptor"
 	"github.com/rancher/websocket-proxy/proxy/proxyprotocol"
@@ -31,39 +33,127 @@ type Starter struct {
 	FrontendPaths      []string
 	FrontendHTTPPaths  []string
 	StatsPaths         []string
+	PortForwardPaths   []string
 	CattleProxyPaths   []string
 	CattleWSProxyPaths []string
+	ReverseHandlers    map[string]http.Handler
 	Config             *Config
+
+	frontendCompression common.CompressionStats
+	backendCompression  common.CompressionStats
+	mu                  sync.Mutex
+	backends            *backendProxyManager
+	cluster             *cluster
+}
+
+// CompressionStats returns how many bytes have been sent and received on compressed frontend and
+// backend websockets.
+func (s *Starter) CompressionStats() (frontend, backend common.CompressionCounts) {
+	return s.frontendCompression.Counts(), s.backendCompression.Counts()
+}
+
+// Drain prepares the proxy to shut down. Backends are told it is going away, new streams and
+// backend connections are refused, and open streams get the configured DrainGracePeriod to finish.
+// It returns once every backend has disconnected, or closes the remaining ones when ctx is done,
+// and then stops announcing backends to the other replicas.
+func (s *Starter) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	backends := s.backends
+	cluster := s.cluster
+	s.mu.Unlock()
+	if backends == nil {
+		return nil
+	}
+	err := backends.drain(ctx)
+	cluster.stop()
+	return err
+}
+
+// BackendRTT returns the smoothed round trip time to the backend for a host, measured with the
+// pings the proxy sends it. It returns false if the host has no backend or it hasn't answered yet.
+func (s *Starter) BackendRTT(hostKey string) (time.Duration, bool) {
+	s.mu.Lock()
+	backends := s.backends
+	s.mu.Unlock()
+	if backends == nil {
+		return 0, false
+	}
+	return backends.rtt(hostKey)
 }
 
 func (s *Starter) StartProxy() error {
 	switcher := NewSwitcher(s.Config)
+	frontendCompression := s.Config.compression(&s.frontendCompression)
+	backendCompression := s.Config.compression(&s.backendCompression)
+
+	cluster, err := newCluster(s.Config)
+	if err != nil {
+		return err
+	}
 
-	backendMultiplexers := make(map[string]*multiplexer)
+	backendMultiplexers := make(map[string][]*multiplexer)
 	bpm := &backendProxyManager{
-		multiplexers: backendMultiplexers,
-		mu:           &sync.RWMutex{},
+		multiplexers:     backendMultiplexers,
+		mu:               &sync.RWMutex{},
+		windowSize:       s.Config.StreamWindowSize,
+		maxFrameSize:     s.Config.MaxFrameSize,
+		maxMessageSize:   s.Config.MaxMessageSize,
+		compression:      backendCompression,
+		errorBudget:      s.Config.ProtocolErrorBudget,
+		gracePeriod:      s.Config.DrainGracePeriod,
+		livenessTimeout:  s.Config.BackendLivenessTimeout,
+		maxLinks:         s.Config.MaxBackendLinks,
+		resumeGrace:      s.Config.ResumeGracePeriod,
+		replayBufferSize: s.Config.ResumeBufferSize,
+		events:           newEventBus(s.Config),
+		reverse: &reverseRouter{
+			destinations: s.Config.ReverseDestinations,
+			handlers:     s.ReverseHandlers,
+		},
 	}
+	if cluster != nil {
+		bpm.registry = cluster.registry
+	}
+
+	s.mu.Lock()
+	s.backends = bpm
+	s.cluster = cluster
+	s.mu.Unlock()
 
 	frontendHandler := switcher.Wrap(&FrontendHandler{
 		backend:         bpm,
 		parsedPublicKey: s.Config.PublicKey,
+		compression:     frontendCompression,
+		cluster:         cluster,
+	})
+
+	portForwardHandler := switcher.Wrap(&FrontendPortForwardHandler{
+		FrontendHandler: FrontendHandler{
+			backend:         bpm,
+			parsedPublicKey: s.Config.PublicKey,
+			compression:     frontendCompression,
+			cluster:         cluster,
+		},
 	})
 
 	statsHandler := switcher.Wrap(&StatsHandler{
 		backend:         bpm,
 		parsedPublicKey: s.Config.PublicKey,
+		compression:     frontendCompression,
+		cluster:         cluster,
 	})
 
 	backendHandler := switcher.Wrap(&BackendHandler{
 		proxyManager:    bpm,
 		parsedPublicKey: s.Config.PublicKey,
+		compression:     backendCompression,
 	})
 
 	frontendHTTPHandlerInner := &FrontendHTTPHandler{
 		FrontendHandler: FrontendHandler{
 			backend:         bpm,
 			parsedPublicKey: s.Config.PublicKey,
+			cluster:         cluster,
 		},
 		HTTPSPorts:  s.Config.ProxyProtoHTTPSPorts,
 		TokenLookup: NewTokenLookup(s.Config.CattleAddr),
@@ -88,27 +178,51 @@ func (s *Starter) StartProxy() error {
 
 	router := mux.NewRouter()
 
+	if cluster != nil {
+		if announcements, ok := cluster.registry.(http.Handler); ok {
+			router.Handle(clusterBackendsPath, announcements).Methods("POST")
+		}
+	}
+
 	for _, p := range s.BackendPaths {
 		router.Handle(p, backendHandler).Methods("GET")
 	}
+	frontendStreams := func(req *http.Request) string {
+		return frontendStreamType(req.URL.Path)
+	}
 	for _, p := range s.FrontendPaths {
-		router.Handle(p, frontendHandler).Methods("GET")
+		router.Handle(p, countStreams(frontendHandler, frontendStreams)).Methods("GET")
 	}
 	for _, p := range s.FrontendHTTPPaths {
-		router.Handle(p, frontendHTTPHandler).Methods("GET", "POST", "PUT", "DELETE", "PATCH", "HEAD")
+		router.Handle(p, countStreams(frontendHTTPHandler, streamsOf(streamContainerProxy))).
+			Methods("GET", "POST", "PUT", "DELETE", "PATCH", "HEAD")
+	}
+	for _, p := range s.PortForwardPaths {
+		router.Handle(p, countStreams(portForwardHandler, streamsOf(streamPortForward))).Methods("GET")
 	}
 	for _, p := range s.StatsPaths {
-		router.Handle(p, statsHandler).Methods("GET")
+		router.Handle(p, countStreams(statsHandler, streamsOf(streamStats))).Methods("GET")
 	}
 
 	for _, p := range s.CattleWSProxyPaths {
-		router.Handle(p, cattleWsProxy)
+		router.Handle(p, countStreams(cattleWsProxy, streamsOf(streamCattle)))
 	}
 
-	router.Handle("/k8s/clusters/{clusterId}{path:.*}", k8sHandler)
+	router.Handle("/k8s/clusters/{clusterId}{path:.*}", countStreams(k8sHandler, streamsOf(streamK8s)))
 
 	for _, p := range s.CattleProxyPaths {
-		router.Handle(p, cattleProxy)
+		router.Handle(p, countStreams(cattleProxy, streamsOf(streamCattle)))
+	}
+
+	if s.Config.AdminListenAddr != "" {
+		adminServer := &http.Server{
+			Handler: newAdminHandler(bpm, s.Config.AdminToken),
+			Addr:    s.Config.AdminListenAddr,
+		}
+		go func() {
+			log.Infof("Serving the admin API on [%s].", s.Config.AdminListenAddr)
+			log.Error(adminServer.ListenAndServe())
+		}()
 	}
 
 	if s.Config.ParentPid != 0 {
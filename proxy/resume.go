@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+// parkedStream is a stream whose link was lost, kept for its backend to resume until timer fires.
+type parkedStream struct {
+	stream *stream
+	timer  *time.Timer
+}
+
+// park keeps a stream of a lost link for the backend's resume grace period. Frontend messages sent
+// meanwhile are buffered by the stream, and it is closed if the backend doesn't resume it in time.
+func (b *backendProxyManager) park(backendKey string, s *stream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.draining {
+		s.closeWith(common.NewClose(s.key, common.CloseGoingAway, "proxy is shutting down"))
+		return
+	}
+
+	if b.parked == nil {
+		b.parked = make(map[string]map[string]*parkedStream)
+	}
+	if b.parked[backendKey] == nil {
+		b.parked[backendKey] = make(map[string]*parkedStream)
+	}
+	b.parked[backendKey][s.key] = &parkedStream{
+		stream: s,
+		timer: time.AfterFunc(b.resumeGrace, func() {
+			if b.unpark(backendKey, s.key) == nil {
+				return
+			}
+			log.Infof("Stream %v of backend %v was not resumed within %v, closing it.", s.key, backendKey, b.resumeGrace)
+			s.closeWith(common.NewClose(s.key, common.CloseGoingAway, "backend disconnected"))
+		}),
+	}
+}
+
+// unpark takes a stream out of the parked streams, returning nil if it isn't parked.
+func (b *backendProxyManager) unpark(backendKey, msgKey string) *stream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	parked, ok := b.parked[backendKey][msgKey]
+	if !ok {
+		return nil
+	}
+	parked.timer.Stop()
+	delete(b.parked[backendKey], msgKey)
+	if len(b.parked[backendKey]) == 0 {
+		delete(b.parked, backendKey)
+	}
+	return parked.stream
+}
+
+// closeParked closes every parked stream.
+func (b *backendProxyManager) closeParked(reason string) {
+	b.mu.Lock()
+	parked := b.parked
+	b.parked = nil
+	b.mu.Unlock()
+
+	for _, streams := range parked {
+		for key, p := range streams {
+			p.timer.Stop()
+			p.stream.closeWith(common.NewClose(key, common.CloseGoingAway, reason))
+		}
+	}
+}
+
+// resume finds the stream a backend asked to resume on link m and detaches it from its old link. The
+// backend may notice a link is dead before the proxy does, so streams still on another of its links
+// are taken from it. It returns nil if the backend has no such stream.
+func (b *backendProxyManager) resume(backendKey, msgKey string, m *multiplexer) *stream {
+	if s := b.unpark(backendKey, msgKey); s != nil {
+		return s
+	}
+
+	b.mu.RLock()
+	links := append([]*multiplexer(nil), b.multiplexers[backendKey]...)
+	b.mu.RUnlock()
+	for _, other := range links {
+		if other == m {
+			continue
+		}
+		other.streamsMu.Lock()
+		s, ok := other.streams[msgKey]
+		if ok && s.replay != nil {
+			delete(other.streams, msgKey)
+		}
+		other.streamsMu.Unlock()
+		if ok && s.replay != nil {
+			s.park()
+			return s
+		}
+	}
+	return nil
+}
+
+// resumable is true if streams on the link are kept for the backend to resume when it is lost.
+func (m *multiplexer) resumable() bool {
+	return m.resumeGrace > 0 && m.capabilities().Supports(common.Resume)
+}
+
+// canResume is true if the streams of a link lost with err should be parked. Links that were closed
+// cleanly, drained or cut off for breaking the protocol aren't coming back.
+func (m *multiplexer) canResume(err error) bool {
+	if !m.resumable() || m.isDraining() {
+		return false
+	}
+	if m.errorBudget >= 0 && m.errorCount() > m.errorBudget {
+		return false
+	}
+	return !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
+// resume answers a backend's request to move a stream to this link.
+func (m *multiplexer) resume(message common.Message) error {
+	received, err := common.ParseResume(message)
+	if err != nil {
+		return err
+	}
+	if !m.resumable() {
+		return fmt.Errorf("Resume of %v on a link that can't be resumed", message.Key)
+	}
+
+	s := m.proxyManager.resume(m.backendKey, message.Key, m)
+	if s == nil {
+		log.Infof("Backend %v tried to resume unknown stream %v.", m.backendKey, message.Key)
+		m.scheduler.Push(common.NewClose(message.Key, common.CloseNotFound, "stream not found"))
+		return nil
+	}
+	if err := s.resume(m, received); err != nil {
+		log.Warnf("Failed to resume stream %v of backend %v: %v", message.Key, m.backendKey, err)
+		closeMessage := common.NewClose(message.Key, common.CloseGoingAway, "stream could not be resumed")
+		s.closeWith(closeMessage)
+		m.scheduler.Push(closeMessage)
+		return nil
+	}
+	log.Debugf("Resumed stream %v of backend %v - %v.", message.Key, m.backendKey, m.backendSessionID)
+	return nil
+}
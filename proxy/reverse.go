@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+const (
+	reverseDialTimeout = 10 * time.Second
+	reverseBufferSize  = 32 * 1024
+	// BackendKeyHeader is set on requests that agents send to a reverse handler to the key of the
+	// backend that sent them. Any value the agent set is replaced.
+	BackendKeyHeader = "X-Rancher-Backend-Key"
+)
+
+var errDestinationNotFound = errors.New("No such destination")
+
+// reverseRouter connects streams that agents open with ReverseConnect to where they are going:
+// one of the Starter's ReverseHandlers, served in the proxy, or one of the Config's
+// ReverseDestinations, a TCP address.
+type reverseRouter struct {
+	destinations map[string]string
+	handlers     map[string]http.Handler
+}
+
+func (r *reverseRouter) dial(backendKey, destination string) (net.Conn, error) {
+	if r == nil {
+		return nil, errDestinationNotFound
+	}
+	if handler, ok := r.handlers[destination]; ok {
+		proxyConn, handlerConn := net.Pipe()
+		server := &http.Server{Handler: &backendKeyHandler{backendKey: backendKey, handler: handler}}
+		go server.Serve(newSingleConnListener(handlerConn))
+		return proxyConn, nil
+	}
+	if address, ok := r.destinations[destination]; ok {
+		return net.DialTimeout("tcp", address, reverseDialTimeout)
+	}
+	return nil, errDestinationNotFound
+}
+
+type backendKeyHandler struct {
+	backendKey string
+	handler    http.Handler
+}
+
+func (h *backendKeyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	req.Header.Set(BackendKeyHeader, h.backendKey)
+	h.handler.ServeHTTP(rw, req)
+}
+
+// singleConnListener hands one connection to an http.Server and ends Serve once it is closed.
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{closed: make(chan struct{})}
+	l.conn = &notifyingConn{Conn: conn, closed: l.closed}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, errors.New("Listener closed")
+}
+
+func (l *singleConnListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type notifyingConn struct {
+	net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *notifyingConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// reverseConnect opens a stream an agent asked for with ReverseConnect and pipes it to its
+// destination. It is accepted by granting the agent a window, or refused with a Close. The key is
+// the agent's choice, so one that is already in use is a protocol error.
+func (m *multiplexer) reverseConnect(message common.Message) {
+	msgKey := message.Key
+	s := newStream(msgKey, m.windowSize)
+	s.strict = true
+	s.reverse = true
+	s.out = m
+	s.url = message.Body
+	s.sendWindow.Require()
+
+	m.streamsMu.Lock()
+	if _, taken := m.streams[msgKey]; taken {
+		m.streamsMu.Unlock()
+		m.scheduler.Push(common.NewClose(msgKey, common.CloseProtocolError, "stream key is already in use"))
+		m.violation(m.ws, fmt.Errorf("ReverseConnect to %q with the key of open stream %v", message.Body, msgKey))
+		return
+	}
+	// Hold the key while dialing so that it can't be taken meanwhile
+	m.streams[msgKey] = s
+	m.streamsMu.Unlock()
+
+	conn, err := m.reverse.dial(m.backendKey, message.Body)
+	if err != nil {
+		m.streamsMu.Lock()
+		if m.streams[msgKey] == s {
+			delete(m.streams, msgKey)
+		}
+		m.streamsMu.Unlock()
+
+		log.Infof("Backend %v couldn't open a stream to %q: %v", m.backendKey, message.Body, err)
+		code := common.CloseBadGateway
+		if err == errDestinationNotFound {
+			code = common.CloseNotFound
+		}
+		m.scheduler.Push(common.NewClose(msgKey, code, err.Error()))
+		return
+	}
+
+	go s.deliver(func(n int) {
+		m.scheduler.Push(common.NewWindowUpdate(msgKey, n))
+	})
+	go m.reverseToDestination(s, conn)
+	go m.reverseFromDestination(s, conn)
+	m.scheduler.Push(common.NewWindowUpdate(msgKey, s.recvWindow.Size()))
+}
+
+// reverseToDestination writes what the agent sends to the destination until the agent closes the
+// stream.
+func (m *multiplexer) reverseToDestination(s *stream, conn net.Conn) {
+	defer conn.Close()
+	defer m.closeConnection(s.key, false)
+	for message := range s.frontend {
+		switch message.Type {
+		case common.Body:
+			if _, err := conn.Write([]byte(message.Body)); err != nil {
+				return
+			}
+		case common.WriteDone:
+			if c, ok := conn.(interface {
+				CloseWrite() error
+			}); ok {
+				c.CloseWrite()
+			}
+		case common.Close:
+			return
+		}
+	}
+}
+
+// reverseFromDestination sends what the destination writes to the agent and closes the stream
+// when the destination does.
+func (m *multiplexer) reverseFromDestination(s *stream, conn net.Conn) {
+	buffer := make([]byte, reverseBufferSize)
+	for {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			m.send(s.key, string(buffer[:n]), true)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-s.done:
+	default:
+		m.closeConnection(s.key, true)
+	}
+}
@@ -17,6 +17,9 @@ import (
 type StatsHandler struct {
 	backend         backendProxy
 	parsedPublicKey interface{}
+	compression     *common.Compression
+	// cluster, if set, is used to forward stats of backends attached to other replicas.
+	cluster *cluster
 }
 
 type statsInfo struct {
@@ -26,11 +29,11 @@ type statsInfo struct {
 	respChannel <-chan common.Message
 }
 
-func (s *statsInfo) initializeClient(h *StatsHandler) error {
+func (s *statsInfo) initializeClient(h *StatsHandler, remote string) error {
 	if s.hostKey == "" {
 		return fmt.Errorf("hostKey is empty")
 	}
-	msgKey, respChannel, err := h.backend.initializeClient(s.hostKey)
+	msgKey, respChannel, err := h.backend.initializeClient(s.hostKey, remote)
 	if err != nil {
 		return err
 	}
@@ -54,8 +57,12 @@ func (h *StatsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		multiHost = true
 	}
 
-	tokenString, authToken, err := h.auth(req)
-	if err != nil {
+	tokenString, authToken, err := h.auth(req, multiHost)
+	if remote, ok := err.(remoteBackendError); ok {
+		h.cluster.forward(rw, req, remote.peer)
+		return
+	} else if err != nil {
+		authFailed(err)
 		http.Error(rw, "Failed authentication", 401)
 		return
 	}
@@ -63,7 +70,7 @@ func (h *StatsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
-	ws, err := upgrader.Upgrade(rw, req, nil)
+	ws, err := upgrade(upgrader, h.compression, rw, req, nil)
 	if err != nil {
 		http.Error(rw, "Failed to upgrade connection.", 500)
 		return
@@ -99,7 +106,7 @@ func (h *StatsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}()
 
 	for _, statsInfoStruct := range statsInfoStructs {
-		err := statsInfoStruct.initializeClient(h)
+		err := statsInfoStruct.initializeClient(h, req.RemoteAddr)
 		if err != nil {
 			return
 		}
@@ -116,7 +123,7 @@ func (h *StatsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				case common.Body:
 					mutex.Lock()
 					ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-					if err := ws.WriteMessage(1, []byte(message.Body)); err != nil {
+					if err := h.compression.WriteMessage(ws, 1, []byte(message.Body)); err != nil {
 						errStatus = true
 					}
 					mutex.Unlock()
@@ -144,15 +151,26 @@ func (h *StatsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (h *StatsHandler) auth(req *http.Request) (string, *jwt.Token, error) {
+// auth checks the request's token. Stats of a single host attached to a peer are to be forwarded to
+// it, the hosts of a project or service may be spread over several replicas and are served here.
+func (h *StatsHandler) auth(req *http.Request, multiHost bool) (string, *jwt.Token, error) {
 	tokenString := req.URL.Query().Get("token")
 	token, err := parseRequestToken(tokenString, h.parsedPublicKey)
 	if err != nil {
-		return "", nil, fmt.Errorf("Error parsing stats token. Failing auth. Error: %v", err)
+		return "", nil, authError{authInvalidToken, fmt.Errorf("Error parsing stats token. Failing auth. Error: %v", err)}
 	}
 
 	if !token.Valid {
-		return "", nil, fmt.Errorf("Token not valid")
+		return "", nil, authError{authInvalidToken, fmt.Errorf("Token not valid")}
+	}
+	if _, err := h.cluster.peer(req, unsignedBody); err != nil {
+		return "", nil, authError{authPeerSignature, err}
+	}
+
+	if hostKey, ok := token.Claims["hostUuid"].(string); ok && !multiHost && !h.backend.hasBackend(hostKey) {
+		if peer, ok := h.cluster.owner(req, hostKey); ok {
+			return tokenString, token, remoteBackendError{hostKey: hostKey, peer: peer}
+		}
 	}
 
 	return tokenString, token, nil
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rancher/websocket-proxy/common"
+)
+
+const frontendTimeout = 10 * time.Second
+
+// stream is one frontend connection multiplexed over a backend link. Messages from the backend
+// are queued and delivered to the frontend channel by deliver() so that a slow frontend only holds
+// up its own stream.
+type stream struct {
+	key    string
+	strict bool
+	// reverse streams were opened by the backend with ReverseConnect
+	reverse    bool
+	frontend   chan common.Message
+	sendWindow *common.SendWindow
+	recvWindow *common.ReceiveWindow
+	mu         sync.Mutex
+	queue      *common.DeliveryQueue
+	done       chan struct{}
+	closeOnce  sync.Once
+	// final is delivered to the frontend after the stream is closed, to tell it why
+	final *common.Message
+	// out is the link the stream is on. It is nil while the stream is parked, waiting for its
+	// backend to reconnect and resume it.
+	out    *multiplexer
+	outMu  sync.Mutex
+	sendMu sync.Mutex
+	// replay keeps what was sent to the backend so that the stream can be resumed. It is nil for
+	// streams on links that can't be resumed.
+	replay   *common.ReplayBuffer
+	received uint64
+	// url, remote and started describe the stream for the admin API, url is set once the backend is
+	// asked to connect it. bytesIn counts the body bytes from the frontend, bytesOut those delivered
+	// to it.
+	url      string
+	remote   string
+	started  time.Time
+	bytesIn  int64
+	bytesOut int64
+}
+
+func newStream(key string, windowSize int) *stream {
+	return &stream{
+		key:        key,
+		started:    time.Now(),
+		frontend:   make(chan common.Message),
+		sendWindow: common.NewSendWindow(),
+		recvWindow: common.NewReceiveWindow(windowSize),
+		queue:      common.NewDeliveryQueue(),
+		done:       make(chan struct{}),
+	}
+}
+
+// enqueue queues a message from the backend for the frontend. If the backend does flow control it
+// never blocks, and on strict links (where the backend waits for our first grant) overrunning the
+// window is an error. Otherwise it waits for room in the queue like the old unbuffered channel did.
+func (s *stream) enqueue(message common.Message, credit int) error {
+	flowControl := s.sendWindow.Enabled()
+	if flowControl && s.strict && s.queue.Bytes() > 2*s.recvWindow.Size() {
+		return fmt.Errorf("Backend exceeded flow control window for key %v", s.key)
+	}
+
+	timeout := time.NewTimer(frontendTimeout)
+	defer timeout.Stop()
+	if err := s.queue.Push(message, credit, flowControl, s.done, timeout.C); err != nil {
+		frontendTimeoutsMetric.Inc()
+		return fmt.Errorf("Timed out sending message with key %v to frontend channel", s.key)
+	}
+	return nil
+}
+
+// deliver feeds queued messages to the frontend channel until the stream is closed, then closes
+// the channel. grant is called with credit to return to the backend as bodies are consumed.
+func (s *stream) deliver(grant func(n int)) {
+	defer close(s.frontend)
+	for {
+		queued, ok := s.queue.Next(s.done)
+		if !ok {
+			s.deliverFinal()
+			return
+		}
+
+		select {
+		case s.frontend <- queued.Message:
+		case <-s.done:
+			s.deliverFinal()
+			return
+		}
+		if queued.Message.Type == common.Body {
+			atomic.AddInt64(&s.bytesOut, int64(len(queued.Message.Body)))
+		}
+		s.queue.Delivered()
+		s.credit(queued.Credit, grant)
+	}
+}
+
+// credit counts n body bytes as consumed, calling grant when enough have been to return credit.
+func (s *stream) credit(n int, grant func(n int)) {
+	if n == 0 || !s.sendWindow.Enabled() {
+		return
+	}
+	if n := s.recvWindow.Consume(n); n > 0 {
+		grant(n)
+	}
+}
+
+func (s *stream) setURL(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.url = url
+}
+
+func (s *stream) getURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.url
+}
+
+// link returns the link the stream is on, or nil while it is parked.
+func (s *stream) link() *multiplexer {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	return s.out
+}
+
+func (s *stream) setLink(m *multiplexer) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	s.out = m
+}
+
+// send passes a message from the frontend on to the backend, keeping it for replay if the stream
+// can be resumed. While the stream is parked it is only kept.
+func (s *stream) send(message common.Message) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if message.Type == common.Body {
+		atomic.AddInt64(&s.bytesIn, int64(len(message.Body)))
+	}
+	if s.replay != nil {
+		s.replay.Add(message)
+	}
+	if m := s.link(); m != nil {
+		m.push(s, message)
+	}
+}
+
+// grant returns credit to the backend. Credit is dropped while the stream is parked, the window
+// starts over when it is resumed.
+func (s *stream) grant(n int) {
+	if m := s.link(); m != nil {
+		m.scheduler.Push(common.NewWindowUpdate(s.key, n))
+	}
+}
+
+// countReceived counts a sequenced message from the backend, see common.Resume.
+func (s *stream) countReceived() {
+	if s.replay != nil {
+		atomic.AddUint64(&s.received, 1)
+	}
+}
+
+// park detaches the stream from a link that was lost. Sends no longer wait for credit, they are
+// kept until the stream is resumed or given up on.
+func (s *stream) park() {
+	s.sendWindow.Suspend()
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.setLink(nil)
+}
+
+// resume moves a parked stream to a new link. The backend is told how much the proxy received,
+// granted a new window and sent what it missed, which doesn't wait for credit since it was already
+// counted against the old window.
+func (s *stream) resume(m *multiplexer, received uint64) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	missing, err := s.replay.Since(received)
+	if err != nil {
+		return err
+	}
+
+	m.streamsMu.Lock()
+	m.streams[s.key] = s
+	m.streamsMu.Unlock()
+	s.setLink(m)
+
+	s.sendWindow.Reset()
+	s.recvWindow.Reset()
+	m.scheduler.Push(common.NewResume(s.key, atomic.LoadUint64(&s.received)))
+	if s.sendWindow.Enabled() {
+		m.scheduler.Push(common.NewWindowUpdate(s.key, s.recvWindow.Size()))
+	}
+	for _, message := range missing {
+		m.push(nil, message)
+	}
+	return nil
+}
+
+func (s *stream) deliverFinal() {
+	if s.final == nil {
+		return
+	}
+	timeout := time.NewTimer(time.Second)
+	defer timeout.Stop()
+	select {
+	case s.frontend <- *s.final:
+	case <-timeout.C:
+	}
+}
+
+// closeWith closes the stream, telling the frontend why with a Close message if it is still listening.
+func (s *stream) closeWith(message common.Message) {
+	s.closeOnce.Do(func() {
+		s.final = &message
+		close(s.done)
+		s.sendWindow.Close()
+	})
+}
+
+func (s *stream) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.sendWindow.Close()
+	})
+}
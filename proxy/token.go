@@ -42,8 +42,10 @@ func NewTokenLookup(cattleAddr string) *TokenLookup {
 func (t *TokenLookup) Lookup(r *http.Request) (string, error) {
 	cacheKey, token := t.getFromCache(r)
 	if token != "" {
+		tokenLookupsMetric.WithLabelValues("hit").Inc()
 		return token, nil
 	}
+	tokenLookupsMetric.WithLabelValues("miss").Inc()
 
 	token, err := t.callRancher(r)
 	if err != nil {